@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/bits"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// 放大时同一个 pcap 的所有 variant 使用相同的客户端/服务端网段, 只有客户端地址不同:
+// 第 k 个 variant 的客户端地址为其所在前缀内之后的第 k 个可用地址, 跳过网络地址, 广播地址和服务端地址
+// 客户端前缀为改写后的客户端网段, 保留 IP, 匿名化或使用 ip_map 时为地址所在的 /24 (IPv6 为 /120),
+// 前缀内的可用地址不足 amplify 个时才扩大前缀, 比如 use_part_4 时客户端为 c1.c2.c3.c4 起连续的地址
+const (
+	maxAmplify     = 1 << 16
+	amplifyPrefix4 = 24
+	amplifyPrefix6 = 120
+)
+
+// pcapVariant 描述要生成的一个 variant
+type pcapVariant struct {
+	seed         int64 // pcap 的种子, 决定客户端/服务端网段, 放大得到的 variant 相同
+	amplifyIndex int   // 放大时 variant 的序号, 不放大时为 0
+	amplify      int   // 每个 pcap 放大得到的 variant 数量, 不放大时为 1
+}
+
+// variantSeed 返回其余随机修改使用的种子, 不放大或第 0 个 variant 与 pcap 的种子相同
+func (v pcapVariant) variantSeed() int64 {
+	if v.amplifyIndex == 0 {
+		return v.seed
+	}
+	return mixSeed(v.seed, "amplify", strconv.Itoa(v.amplifyIndex))
+}
+
+// hostAmplifier 计算第 index 个 variant 的客户端地址, 同一个地址只计算一次
+type hostAmplifier struct {
+	index   int
+	amplify int
+	prefix4 int
+	prefix6 int
+	servers []net.IP // 改写后的服务端地址
+	hosts   map[string]net.IP
+}
+
+// newHostAmplifier 创建 amplifier, endpoints 为 nil 时使用默认的客户端前缀
+func newHostAmplifier(variant pcapVariant, endpoints *EndPoints) *hostAmplifier {
+	a := &hostAmplifier{
+		index:   variant.amplifyIndex,
+		amplify: variant.amplify,
+		prefix4: amplifyPrefix4,
+		prefix6: amplifyPrefix6,
+		hosts:   make(map[string]net.IP),
+	}
+	if endpoints != nil {
+		if endpoints.client4 != nil {
+			a.prefix4, _ = endpoints.client4.Mask.Size()
+		}
+		if endpoints.client6 != nil {
+			a.prefix6, _ = endpoints.client6.Mask.Size()
+		}
+	}
+	return a
+}
+
+func (a *hostAmplifier) addServer(ip net.IP) {
+	a.servers = append(a.servers, ip)
+}
+
+// amplifyHost 返回客户端地址 ip 在该 variant 中的地址
+func (a *hostAmplifier) amplifyHost(ip net.IP) net.IP {
+	if a.index == 0 {
+		return ip
+	}
+	if newIP, ok := a.hosts[string(ip)]; ok {
+		return newIP
+	}
+
+	prefix := a.prefix4
+	if len(ip) == net.IPv6len {
+		prefix = a.prefix6
+	}
+	// 至少需要 amplify 个可用地址, 主机位不超过 30 位, 以便在最后 4 个字节中计算
+	hostBits := len(ip)*8 - prefix
+	if min := bits.Len(uint(a.amplify + 1)); hostBits < min {
+		hostBits = min
+	}
+	skipped := a.skippedHosts(ip, hostBits)
+	for hostBits < 30 && 1<<hostBits-len(skipped) < a.amplify {
+		hostBits++
+		skipped = a.skippedHosts(ip, hostBits)
+	}
+
+	// 先计算 ip 在可用地址中的位置, 后移 index 个可用地址后再还原为主机位
+	size := uint32(1) << hostBits
+	host := hostPart(ip, hostBits)
+	position := host
+	for _, s := range skipped {
+		if s < host {
+			position--
+		}
+	}
+	target := (position + uint32(a.index)) % (size - uint32(len(skipped)))
+	for _, s := range skipped {
+		if s <= target {
+			target++
+		}
+	}
+
+	newIP := append(net.IP(nil), ip...)
+	tail := newIP[len(newIP)-4:]
+	binary.BigEndian.PutUint32(tail, binary.BigEndian.Uint32(tail)&^(size-1)|target)
+	a.hosts[string(ip)] = newIP
+	return newIP
+}
+
+// skippedHosts 返回 ip 所在前缀内不能使用的主机位, 按照从小到大排列
+func (a *hostAmplifier) skippedHosts(ip net.IP, hostBits int) []uint32 {
+	size := uint32(1) << hostBits
+	skipped := []uint32{0}
+	if len(ip) == net.IPv4len {
+		skipped = append(skipped, size-1)
+	}
+	for _, server := range a.servers {
+		if len(server) != len(ip) || !samePrefix(server, ip, hostBits) {
+			continue
+		}
+		host := hostPart(server, hostBits)
+		if !containsHost(skipped, host) {
+			skipped = append(skipped, host)
+		}
+	}
+	sort.Slice(skipped, func(i, j int) bool { return skipped[i] < skipped[j] })
+	return skipped
+}
+
+func hostPart(ip net.IP, hostBits int) uint32 {
+	return binary.BigEndian.Uint32(ip[len(ip)-4:]) & (1<<hostBits - 1)
+}
+
+// samePrefix 判断两个长度相同的地址除了低 hostBits 位以外是否相同
+func samePrefix(a, b net.IP, hostBits int) bool {
+	n := len(a) - 4
+	if !bytes.Equal(a[:n], b[:n]) {
+		return false
+	}
+	return binary.BigEndian.Uint32(a[n:])>>hostBits == binary.BigEndian.Uint32(b[n:])>>hostBits
+}
+
+func containsHost(hosts []uint32, host uint32) bool {
+	for _, h := range hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+)
+
+// cryptoPAnKeyLen 为 Crypto-PAn 的密钥长度, 前 16 字节是 AES 密钥, 后 16 字节用于生成填充
+const cryptoPAnKeyLen = 32
+
+// parseAnonymizeKey 解析匿名化密钥, 64 位十六进制字符串直接作为密钥, 其余字符串取 SHA-256
+func parseAnonymizeKey(s string) []byte {
+	if key, err := hex.DecodeString(s); err == nil && len(key) == cryptoPAnKeyLen {
+		return key
+	}
+	sum := sha256.Sum256([]byte(s))
+	return sum[:]
+}
+
+// cryptoPAn 实现前缀保留的 IP 地址匿名化 (Xu et al., Crypto-PAn), 同样的密钥总是得到同样的结果
+// 两个地址的公共前缀长度在匿名化前后保持不变, 因此网段结构得以保留, IPv4 和 IPv6 使用同一个密钥
+type cryptoPAn struct {
+	block cipher.Block
+	pad   [aes.BlockSize]byte
+	cache map[string]net.IP
+}
+
+// newCryptoPAn 使用 cryptoPAnKeyLen 字节的密钥创建匿名化器
+func newCryptoPAn(key []byte) *cryptoPAn {
+	// 密钥长度固定为 16 字节, 不会出错
+	block, _ := aes.NewCipher(key[:16])
+	c := &cryptoPAn{block: block, cache: make(map[string]net.IP)}
+	block.Encrypt(c.pad[:], key[16:cryptoPAnKeyLen])
+	return c
+}
+
+// anonymize 返回匿名化后的地址, 第 i 位由原地址的前 i 位 (其余位使用填充) 加密后的最高位与原地址的第 i 位异或得到
+func (c *cryptoPAn) anonymize(ip net.IP) net.IP {
+	if anonymized, ok := c.cache[string(ip)]; ok {
+		return anonymized
+	}
+
+	bits := len(ip) * 8
+	var input, output [aes.BlockSize]byte
+	result := make(net.IP, len(ip))
+	for i := 0; i < bits; i++ {
+		// 前 i 位来自原地址, 其余来自填充
+		copy(input[:], c.pad[:])
+		for j := 0; j < i/8; j++ {
+			input[j] = ip[j]
+		}
+		if r := i % 8; r != 0 {
+			mask := byte(0xff) << (8 - r)
+			input[i/8] = ip[i/8]&mask | c.pad[i/8]&^mask
+		}
+
+		c.block.Encrypt(output[:], input[:])
+		result[i/8] |= (output[0] >> 7) << (7 - i%8)
+	}
+	for i := range result {
+		result[i] ^= ip[i]
+	}
+
+	c.cache[string(ip)] = result
+	return result
+}
@@ -13,10 +13,18 @@ type Command struct {
 	Command   string                 `mapstructure:"command"`
 	Vars      map[string]interface{} `mapstructure:"vars"`
 	Directory string                 `mapstructure:"directory"`
-	Type      string                 `mapstructure:"type"` // shell or pcap, default is pcap
+	Type      string                 `mapstructure:"type"` // shell, pcap or merge, default is pcap
 	Timeout   time.Duration          `mapstructure:"timeout"`
 	FinderId  string                 `mapstructure:"finder"` // if not provide, use Job's
 
+	// merge 类型的命令将每个 pcap 生成的 variant 合并写出到 Command 指定的路径
+	MergeMode   string        `mapstructure:"merge_mode"`   // interleave 或 concat, 默认 interleave
+	MergeOffset time.Duration `mapstructure:"merge_offset"` // interleave 时每个 pcap 依次后移的时间, concat 时相邻 variant 的间隔
+	// 放大: 每个 pcap 生成 Amplify 个 variant, 客户端/服务端网段相同, 第 k 个 variant 的客户端为其前缀内之后的第 k 个可用地址,
+	// interleave 时均匀错开在 AmplifySpread 内, 比如 500 个客户端错开在 1h 内
+	Amplify       int           `mapstructure:"amplify"`
+	AmplifySpread time.Duration `mapstructure:"amplify_spread"`
+
 	job    *Job
 	finder *Finder
 }
@@ -42,8 +50,33 @@ func (c *Command) check() error {
 		c.Type = "pcap"
 	}
 
-	if c.Type != "shell" && c.Type != "pcap" {
-		return errors.New(fmt.Sprintf("unsupported command type: %s, currently only pcap and shell support", c.Type))
+	if c.Type != "shell" && c.Type != "pcap" && c.Type != "merge" {
+		return errors.New(fmt.Sprintf("unsupported command type: %s, currently only pcap, shell and merge support", c.Type))
+	}
+
+	if c.Type == "merge" {
+		if c.MergeMode == "" {
+			c.MergeMode = mergeInterleave
+		}
+		if err := checkMergeMode(c.MergeMode); err != nil {
+			return err
+		}
+		if c.MergeOffset < 0 {
+			return errors.New("merge offset can't be negative")
+		}
+	}
+
+	if c.Amplify == 0 {
+		c.Amplify = 1
+	}
+	if c.Amplify < 0 || c.Amplify > maxAmplify {
+		return errors.New(fmt.Sprintf("invalid amplify: %d, must be in [1, %d]", c.Amplify, maxAmplify))
+	}
+	if c.Amplify > 1 && c.Type != "merge" {
+		return errors.New("amplify is only supported by merge command")
+	}
+	if c.AmplifySpread < 0 {
+		return errors.New("amplify spread can't be negative")
 	}
 
 	if c.FinderId == "" {
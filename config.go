@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"github.com/mitchellh/go-homedir"
 	"os"
 	"path/filepath"
 	"time"
@@ -19,13 +20,20 @@ type Config struct {
 	Duration            time.Duration `mapstructure:"duration"`
 	CommandTimeout      time.Duration `mapstructure:"command_timeout"`
 	TemporaryDirectory  string        `mapstructure:"temporary_directory"`
+	IndexFile           string        `mapstructure:"index_file"`
 	SelectedJobs        []string      `mapstructure:"jobs"`
+	Seed                int64         `mapstructure:"seed"`         // 0 表示随机生成
+	VariantSeed         int64         `mapstructure:"variant_seed"` // 非 0 时直接作为每个 pcap 的种子, 用于重新生成某个 variant
 
 	AsDaemon bool   `mapstructure:"daemon"`
 	Pingback string `mapstructure:"pingback"`
 
 	FastCopyDirectory string            `mapstructure:"fast_copy"`
 	FastMergePcapPath string            `mapstructure:"fast_merge"`
+	MergeMode         string            `mapstructure:"merge_mode"`
+	MergeOffset       time.Duration     `mapstructure:"merge_offset"`
+	Amplify           int               `mapstructure:"amplify"`
+	AmplifySpread     time.Duration     `mapstructure:"amplify_spread"`
 	Vars              map[string]string `mapstructure:"vars"`
 
 	KeepData           bool `mapstructure:"keep_data"`
@@ -60,6 +68,9 @@ func (c *Config) check() error {
 	if c.CommandTimeout <= 0 {
 		return errors.New("default command timeout can't be zero")
 	}
+	if c.Seed == 0 {
+		c.Seed = newBaseSeed()
+	}
 
 	absTemporaryDirectory, _ := filepath.Abs(c.TemporaryDirectory)
 	if err := os.MkdirAll(absTemporaryDirectory, os.ModePerm); err != nil {
@@ -71,5 +82,10 @@ func (c *Config) check() error {
 		return errors.New(fmt.Sprintf("error when create working directory: %s", err))
 	}
 	c.daemonLogPath = filepath.Join(c.workingDirectory, "prsdata.log")
+
+	if c.IndexFile != "" {
+		indexFile, _ := homedir.Expand(c.IndexFile)
+		c.IndexFile, _ = filepath.Abs(indexFile)
+	}
 	return nil
 }
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/google/gopacket/layers"
+)
+
+// EndPoints 描述 IP 改写的目标网段, 等价于 tcprewrite 的 --endpoints 参数
+// 客户端发出的 packet, 源地址改写到 client 网段, 目的地址改写到 server 网段, 服务端发出的 packet 反之
+// 改写时保留原地址中网段以外的主机位, 掩码为全长时即改写为固定地址
+type EndPoints struct {
+	client4 *net.IPNet
+	server4 *net.IPNet
+	client6 *net.IPNet
+	server6 *net.IPNet
+
+	preferIPv6 bool // 仅影响 String 的输出
+}
+
+func (e *EndPoints) String() string {
+	if e.preferIPv6 {
+		return fmt.Sprintf("[%s]:[%s]", e.client6, e.server6)
+	}
+	return fmt.Sprintf("%s:%s", e.client4, e.server4)
+}
+
+// rewrite 将地址改写到 client 或 server 网段内, 广播/组播等地址保持不变
+func (e *EndPoints) rewrite(ip net.IP, toClient bool) net.IP {
+	if ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+		return ip
+	}
+
+	var network *net.IPNet
+	if len(ip) == net.IPv4len {
+		network = e.server4
+		if toClient {
+			network = e.client4
+		}
+	} else {
+		network = e.server6
+		if toClient {
+			network = e.client6
+		}
+	}
+	if network == nil || len(network.IP) != len(ip) {
+		return ip
+	}
+
+	newIP := make(net.IP, len(ip))
+	for i := range ip {
+		newIP[i] = (network.IP[i] & network.Mask[i]) | (ip[i] &^ network.Mask[i])
+	}
+	return newIP
+}
+
+// rewriteIPAddresses 使用 rewrite 原地改写 packet 的源/目的地址, 并增量修正 IP 及 TCP/UDP/ICMPv6 的校验和
+func rewriteIPAddresses(data []byte, rewrite func(ip net.IP, isSrc bool) net.IP) bool {
+	view, ok := parseIPPacketView(data)
+	if !ok {
+		return false
+	}
+
+	oldSrc := append(net.IP(nil), view.src...)
+	oldDst := append(net.IP(nil), view.dst...)
+	newSrc := rewrite(oldSrc, true)
+	newDst := rewrite(oldDst, false)
+
+	copy(view.src, newSrc)
+	copy(view.dst, newDst)
+
+	if view.version == 4 {
+		updateChecksum(data, view.ipOffset+10, oldSrc, newSrc)
+		updateChecksum(data, view.ipOffset+10, oldDst, newDst)
+	}
+
+	// L4 校验和包含伪首部, 地址变化后同样需要修正
+	if pos := view.l4ChecksumOffset(len(data)); pos >= 0 {
+		if view.protocol == layers.IPProtocolUDP && view.version == 4 && binary.BigEndian.Uint16(data[pos:]) == 0 {
+			return true // IPv4 UDP 未计算校验和
+		}
+		updateChecksum(data, pos, oldSrc, newSrc)
+		updateChecksum(data, pos, oldDst, newDst)
+		if view.protocol == layers.IPProtocolUDP && binary.BigEndian.Uint16(data[pos:]) == 0 {
+			binary.BigEndian.PutUint16(data[pos:], 0xffff)
+		}
+	}
+	return true
+}
+
+// endpointClassifier 判断 IP 是客户端还是服务端, 与 `tcpprep -a client` 的行为一致:
+// 根据 TCP 握手, 知名端口及 ICMP echo 的方向打分, 仅当表现为服务端的次数更多时视为服务端, 其余均视为客户端
+type endpointClassifier struct {
+	scores map[string]*[2]int // [0] 客户端行为次数, [1] 服务端行为次数
+}
+
+func newEndpointClassifier() *endpointClassifier {
+	return &endpointClassifier{scores: make(map[string]*[2]int)}
+}
+
+func (c *endpointClassifier) mark(ip []byte, server bool) {
+	key := string(ip)
+	score, ok := c.scores[key]
+	if !ok {
+		score = &[2]int{}
+		c.scores[key] = score
+	}
+	if server {
+		score[1]++
+	} else {
+		score[0]++
+	}
+}
+
+func (c *endpointClassifier) add(data []byte) {
+	view, ok := parseIPPacketView(data)
+	if !ok || view.l4Offset < 0 {
+		return
+	}
+	l4 := data[view.l4Offset:]
+
+	switch view.protocol {
+	case layers.IPProtocolTCP:
+		if len(l4) < 14 {
+			return
+		}
+		flags := l4[13]
+		syn, ack := flags&0x02 != 0, flags&0x10 != 0
+		if syn && !ack {
+			c.mark(view.src, false)
+			c.mark(view.dst, true)
+		} else if syn && ack {
+			c.mark(view.src, true)
+			c.mark(view.dst, false)
+		}
+	case layers.IPProtocolUDP:
+		if len(l4) < 4 {
+			return
+		}
+		srcPort, dstPort := binary.BigEndian.Uint16(l4[0:2]), binary.BigEndian.Uint16(l4[2:4])
+		if dstPort < 1024 && srcPort >= 1024 {
+			c.mark(view.src, false)
+			c.mark(view.dst, true)
+		} else if srcPort < 1024 && dstPort >= 1024 {
+			c.mark(view.src, true)
+			c.mark(view.dst, false)
+		}
+	case layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		if len(l4) < 1 {
+			return
+		}
+		switch l4[0] {
+		case layers.ICMPv4TypeEchoRequest, layers.ICMPv6TypeEchoRequest:
+			c.mark(view.src, false)
+			c.mark(view.dst, true)
+		case layers.ICMPv4TypeEchoReply, layers.ICMPv6TypeEchoReply:
+			c.mark(view.src, true)
+			c.mark(view.dst, false)
+		}
+	}
+}
+
+func (c *endpointClassifier) isClient(ip []byte) bool {
+	score, ok := c.scores[string(ip)]
+	if !ok {
+		return true
+	}
+	return score[1] <= score[0]
+}
+
+// servers 返回所有被视为服务端的地址
+func (c *endpointClassifier) servers() []net.IP {
+	var servers []net.IP
+	for key := range c.scores {
+		if ip := net.IP(key); !c.isClient(ip) {
+			servers = append(servers, ip)
+		}
+	}
+	return servers
+}
+
+// classifyPCAP 遍历一次 pcap, 生成客户端/服务端分类信息, 替代 tcpprep 生成的 cache file
+func classifyPCAP(filename string) (*endpointClassifier, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file %s: %w", filename, err)
+	}
+	defer file.Close()
+
+	reader, _, err := newPcapReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	classifier := newEndpointClassifier()
+	for {
+		data, _, err := reader.ZeroCopyReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error when read packet: %w", err)
+		}
+		classifier.add(data)
+	}
+	return classifier, nil
+}
+
+// ipPacketView 记录以太网帧中 IP 层及 L4 层的位置, src / dst 直接引用原始数据, 可用于原地修改
+type ipPacketView struct {
+	ipOffset int
+	version  int
+	src      []byte
+	dst      []byte
+	protocol layers.IPProtocol
+	l4Offset int // 非首个分片或者数据被截断时为 -1
+}
+
+// parseIPPacketView 解析以太网帧(支持 802.1Q / QinQ), 仅定位字段, 不做完整解码
+func parseIPPacketView(data []byte) (*ipPacketView, bool) {
+	offset := 12
+	for {
+		if offset+2 > len(data) {
+			return nil, false
+		}
+		etherType := layers.EthernetType(binary.BigEndian.Uint16(data[offset : offset+2]))
+		offset += 2
+		if etherType == layers.EthernetTypeDot1Q || etherType == layers.EthernetTypeQinQ {
+			offset += 2
+			continue
+		}
+		if etherType != layers.EthernetTypeIPv4 && etherType != layers.EthernetTypeIPv6 {
+			return nil, false
+		}
+		break
+	}
+	return parseIPHeaderView(data, offset)
+}
+
+func parseIPHeaderView(data []byte, offset int) (*ipPacketView, bool) {
+	if offset >= len(data) {
+		return nil, false
+	}
+
+	view := &ipPacketView{ipOffset: offset, version: int(data[offset] >> 4), l4Offset: -1}
+	ip := data[offset:]
+
+	switch view.version {
+	case 4:
+		if len(ip) < 20 {
+			return nil, false
+		}
+		ihl := int(ip[0]&0x0f) * 4
+		view.src = ip[12:16]
+		view.dst = ip[16:20]
+		view.protocol = layers.IPProtocol(ip[9])
+		fragOffset := binary.BigEndian.Uint16(ip[6:8]) & 0x1fff
+		if ihl >= 20 && ihl <= len(ip) && fragOffset == 0 {
+			view.l4Offset = offset + ihl
+		}
+	case 6:
+		if len(ip) < 40 {
+			return nil, false
+		}
+		view.src = ip[8:24]
+		view.dst = ip[24:40]
+		next := layers.IPProtocol(ip[6])
+		pos := 40
+	EXTENSIONS:
+		for {
+			switch next {
+			case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+				if pos+8 > len(ip) {
+					break EXTENSIONS
+				}
+				next = layers.IPProtocol(ip[pos])
+				pos += (int(ip[pos+1]) + 1) * 8
+			case layers.IPProtocolAH:
+				if pos+8 > len(ip) {
+					break EXTENSIONS
+				}
+				next = layers.IPProtocol(ip[pos])
+				pos += (int(ip[pos+1]) + 2) * 4
+			case layers.IPProtocolIPv6Fragment:
+				if pos+8 > len(ip) {
+					break EXTENSIONS
+				}
+				if binary.BigEndian.Uint16(ip[pos+2:pos+4])&0xfff8 != 0 {
+					view.protocol = layers.IPProtocol(ip[pos])
+					return view, true
+				}
+				next = layers.IPProtocol(ip[pos])
+				pos += 8
+			default:
+				view.protocol = next
+				if pos <= len(ip) {
+					view.l4Offset = offset + pos
+				}
+				return view, true
+			}
+		}
+		view.protocol = next
+	default:
+		return nil, false
+	}
+	return view, true
+}
+
+// l4ChecksumOffset 返回包含伪首部的 L4 校验和位置, 不存在或数据不完整时返回 -1
+func (v *ipPacketView) l4ChecksumOffset(length int) int {
+	if v.l4Offset < 0 {
+		return -1
+	}
+	pos := -1
+	switch v.protocol {
+	case layers.IPProtocolTCP:
+		pos = v.l4Offset + 16
+	case layers.IPProtocolUDP:
+		pos = v.l4Offset + 6
+	case layers.IPProtocolICMPv6:
+		pos = v.l4Offset + 2
+	}
+	if pos < 0 || pos+2 > length {
+		return -1
+	}
+	return pos
+}
+
+// updateChecksum 按照 RFC 1624 增量修正 pos 处的校验和, old 和 new 长度必须相同且为偶数
+func updateChecksum(data []byte, pos int, old, new []byte) {
+	sum := uint32(^binary.BigEndian.Uint16(data[pos : pos+2]))
+	for i := 0; i+1 < len(old) && i+1 < len(new); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i : i+2]))
+		sum += uint32(binary.BigEndian.Uint16(new[i : i+2]))
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	binary.BigEndian.PutUint16(data[pos:pos+2], ^uint16(sum))
+}
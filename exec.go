@@ -33,10 +33,28 @@ func execRealCommand(realCommand *RealCommand) *ExecResult {
 	if realCommand.command.Type == "shell" {
 		return execCommand(realCommand.command)
 	} else {
-		pcapPath, err := realCommand.pcap.new()
+		seed := realCommand.seed()
+		logger.Infoln(fmt.Sprintf("%s using seed %d", realCommand, seed))
+		pcapPath, info, err := realCommand.pcap.new(pcapVariant{
+			seed:         seed,
+			amplifyIndex: realCommand.amplifyIndex,
+			amplify:      realCommand.command.Amplify,
+		})
 		if err != nil {
 			return errResult(err)
 		}
+		logger.Debugln(fmt.Sprintf("%s generated %d packets, duration %s, %s, %s", realCommand, info.packetCount,
+			info.CaptureDuration, info.AvgPacketRate, info.DataBitRate))
+
+		if realCommand.command.Type == "merge" {
+			// variant 由 merger 在合并完成后删除
+			realCommand.merger.add(realCommand.index, realCommand.amplifyIndex, pcapPath)
+			if realCommand.pcap.file.finder.modifier.malform() {
+				deleteFile(malformedRecordPath(pcapPath))
+			}
+			return &ExecResult{command: pcapPath, succeed: true}
+		}
+
 		f := File{
 			path:   pcapPath,
 			finder: realCommand.pcap.file.finder,
@@ -44,6 +62,12 @@ func execRealCommand(realCommand *RealCommand) *ExecResult {
 		f.parse()
 		defer f.delete()
 
+		malformedPath := ""
+		if realCommand.pcap.file.finder.modifier.malform() {
+			malformedPath = malformedRecordPath(pcapPath)
+			defer (&File{path: malformedPath}).delete()
+		}
+
 		pcapContext := &PcapContext{
 			WorkingDirectory:  config.workingDirectory,
 			FinderDirectory:   realCommand.pcap.file.finder.workingDirectory,
@@ -56,6 +80,10 @@ func execRealCommand(realCommand *RealCommand) *ExecResult {
 			Ext:               f.ext,
 			HasIpv6:           realCommand.pcap.hasIPv6,
 			PacketCount:       realCommand.pcap.info.packetCount,
+			PacketRate:        info.avgPacketRate,
+			BitRate:           info.dataBitRate,
+			Seed:              seed,
+			MalformedPath:     malformedPath,
 		}
 
 		renderedCommand, err := pcapContext.render(realCommand.command)
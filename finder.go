@@ -363,6 +363,12 @@ func (f *Finder) checkAndLoadPcap(pcap *Pcap) error {
 		}
 	}
 
+	// 文件未发生变化时直接复用索引中的信息, 以及上次加载时准备工作的结果
+	if entry := pcapIndex.lookup(file.path, file.info); entry != nil {
+		pcap.info = entry.pcapInfo()
+		pcap.preparation = entry.Prepared
+	}
+
 	err := pcap.init()
 	if err != nil {
 		pcap.showWhy(fmt.Sprintf("init info failed: %s", err))
@@ -440,7 +446,7 @@ func (f *Finder) checkAndLoadPcap(pcap *Pcap) error {
 		}
 	}
 
-	if f.OnlyIpv6 && !pcap.file.finder.modifier.KeepIp && !pcap.hasIPv6 {
+	if f.OnlyIpv6 && !pcap.file.finder.modifier.keepIP() && !pcap.hasIPv6 {
 		pcap.showWhy(fmt.Sprintf("not contains ipv6 packet"))
 		return nil
 	}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/google/gopacket/layers"
+)
+
+// 分片的输出顺序
+const (
+	fragmentInOrder = "in_order"
+	fragmentReverse = "reverse"
+	fragmentRandom  = "random"
+	fragmentOverlap = "overlap" // 按顺序输出, 每个分片与前一个分片重叠 8 字节, 重叠部分的数据一致
+
+	// IPv4 首部加上 8 字节的数据
+	minFragmentMtu = 28
+)
+
+var fragmentOrders = []string{fragmentInOrder, fragmentReverse, fragmentRandom, fragmentOverlap}
+
+func checkFragmentOrder(order string) error {
+	for _, o := range fragmentOrders {
+		if order == o {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("invalid fragment order: %s, must be one of %s, %s, %s, %s", order,
+		fragmentInOrder, fragmentReverse, fragmentRandom, fragmentOverlap))
+}
+
+// splitRanges 将长度为 length 的数据按照 sizes 依次切分, sizes 循环使用, 每一段与前一段重叠 overlap 字节
+func splitRanges(length int, sizes []int, overlap int) [][2]int {
+	var ranges [][2]int
+	for start, i := 0, 0; ; i++ {
+		end := start + sizes[i%len(sizes)]
+		if end >= length {
+			return append(ranges, [2]int{start, length})
+		}
+		ranges = append(ranges, [2]int{start, end})
+		start = end - overlap
+	}
+}
+
+// ipFragmenter 将超过 MTU 的 IPv4 / IPv6 packet 分片, 已经是分片的 packet 保持不变
+// IPv4 分片清除 DF 标志, 之后的分片只保留需要复制的选项; IPv6 在不可分片部分 (hop-by-hop, routing) 之后插入 fragment 扩展首部
+type ipFragmenter struct {
+	mtu   int
+	order string
+	rand  *rand.Rand
+}
+
+// fragment 返回分片后的以太网帧, 不需要分片时返回 nil
+func (f *ipFragmenter) fragment(data []byte) ([][]byte, error) {
+	offset, etherType, err := ethernetTypeOffset(data)
+	if err != nil {
+		return nil, err
+	}
+	ip := ipDatagram(data[offset+2:])
+	if len(ip) <= f.mtu {
+		return nil, nil
+	}
+
+	var fragments [][]byte
+	switch etherType {
+	case layers.EthernetTypeIPv4:
+		fragments, err = f.fragmentIPv4(ip)
+	case layers.EthernetTypeIPv6:
+		fragments, err = f.fragmentIPv6(ip)
+	default:
+		return nil, nil
+	}
+	if err != nil || fragments == nil {
+		return nil, err
+	}
+
+	switch f.order {
+	case fragmentReverse:
+		for i, j := 0, len(fragments)-1; i < j; i, j = i+1, j-1 {
+			fragments[i], fragments[j] = fragments[j], fragments[i]
+		}
+	case fragmentRandom:
+		f.rand.Shuffle(len(fragments), func(i, j int) {
+			fragments[i], fragments[j] = fragments[j], fragments[i]
+		})
+	}
+
+	frames := make([][]byte, len(fragments))
+	for i, fragment := range fragments {
+		frames[i] = replaceEthernetPayload(data, offset, etherType, fragment)
+	}
+	return frames, nil
+}
+
+// ranges 按照 MTU 切分可分片部分, 每个分片的长度 (最后一个除外) 为 8 的倍数
+func (f *ipFragmenter) ranges(length, headerLen int) ([][2]int, error) {
+	size := (f.mtu - headerLen) &^ 7
+	overlap := 0
+	if f.order == fragmentOverlap {
+		overlap = 8
+	}
+	if size < 8+overlap {
+		return nil, fmt.Errorf("mtu %d is too small for header of %d bytes", f.mtu, headerLen)
+	}
+	return splitRanges(length, []int{size}, overlap), nil
+}
+
+func (f *ipFragmenter) fragmentIPv4(ip []byte) ([][]byte, error) {
+	if len(ip) < 20 {
+		return nil, fmt.Errorf("truncated ipv4 header")
+	}
+	if binary.BigEndian.Uint16(ip[6:8])&0x3fff != 0 {
+		return nil, nil // 已经是分片
+	}
+	ihl := int(ip[0]&0x0f) * 4
+	if ihl < 20 || ihl > len(ip) {
+		return nil, fmt.Errorf("invalid ipv4 header length %d", ihl)
+	}
+
+	// 之后的分片只保留设置了 copied 标志的选项
+	header := append([]byte(nil), ip[:20]...)
+	for pos := 20; pos < ihl; {
+		kind := ip[pos]
+		if kind == 0 { // end of option list
+			break
+		}
+		length := 1
+		if kind != 1 { // no operation
+			if pos+1 >= ihl || ip[pos+1] < 2 || pos+int(ip[pos+1]) > ihl {
+				break
+			}
+			length = int(ip[pos+1])
+		}
+		if kind&0x80 != 0 {
+			header = append(header, ip[pos:pos+length]...)
+		}
+		pos += length
+	}
+	for len(header)%4 != 0 {
+		header = append(header, 0)
+	}
+	header[0] = 0x40 | byte(len(header)/4)
+
+	ranges, err := f.ranges(len(ip)-ihl, ihl)
+	if err != nil {
+		return nil, err
+	}
+	payload := ip[ihl:]
+	fragments := make([][]byte, len(ranges))
+	for i, r := range ranges {
+		h := header
+		if i == 0 {
+			h = ip[:ihl]
+		}
+		fragment := make([]byte, 0, len(h)+r[1]-r[0])
+		fragment = append(append(fragment, h...), payload[r[0]:r[1]]...)
+
+		flagsAndOffset := uint16(r[0] / 8)
+		if r[1] < len(payload) {
+			flagsAndOffset |= 0x2000 // more fragments
+		}
+		binary.BigEndian.PutUint16(fragment[2:4], uint16(len(fragment)))
+		binary.BigEndian.PutUint16(fragment[6:8], flagsAndOffset)
+		binary.BigEndian.PutUint16(fragment[10:12], 0)
+		binary.BigEndian.PutUint16(fragment[10:12], foldChecksum(onesComplementSum(0, fragment[:len(h)])))
+		fragments[i] = fragment
+	}
+	return fragments, nil
+}
+
+func (f *ipFragmenter) fragmentIPv6(ip []byte) ([][]byte, error) {
+	if len(ip) < 40 {
+		return nil, fmt.Errorf("truncated ipv6 header")
+	}
+
+	// 不可分片部分: IPv6 首部, hop-by-hop, routing 以及 routing 之前的 destination options
+	nextPos, pos := 6, 40
+	for {
+		next := layers.IPProtocol(ip[nextPos])
+		if next == layers.IPProtocolIPv6Fragment {
+			return nil, nil // 已经是分片
+		}
+		if next != layers.IPProtocolIPv6HopByHop && next != layers.IPProtocolIPv6Routing && next != layers.IPProtocolIPv6Destination {
+			break
+		}
+		if pos+8 > len(ip) {
+			return nil, fmt.Errorf("truncated ipv6 extension header")
+		}
+		if next == layers.IPProtocolIPv6Destination && layers.IPProtocol(ip[pos]) != layers.IPProtocolIPv6Routing {
+			break
+		}
+		nextPos, pos = pos, pos+(int(ip[pos+1])+1)*8
+		if pos > len(ip) {
+			return nil, fmt.Errorf("truncated ipv6 extension header")
+		}
+	}
+
+	ranges, err := f.ranges(len(ip)-pos, pos+8)
+	if err != nil {
+		return nil, err
+	}
+	payload := ip[pos:]
+	id := f.rand.Uint32()
+	fragments := make([][]byte, len(ranges))
+	for i, r := range ranges {
+		fragment := make([]byte, pos+8, pos+8+r[1]-r[0])
+		copy(fragment, ip[:pos])
+		fragment[nextPos] = byte(layers.IPProtocolIPv6Fragment)
+		fragment[pos] = ip[nextPos]
+
+		offsetAndFlag := uint16(r[0]/8) << 3
+		if r[1] < len(payload) {
+			offsetAndFlag |= 1 // more fragments
+		}
+		binary.BigEndian.PutUint16(fragment[pos+2:], offsetAndFlag)
+		binary.BigEndian.PutUint32(fragment[pos+4:], id)
+
+		fragment = append(fragment, payload[r[0]:r[1]]...)
+		binary.BigEndian.PutUint16(fragment[4:6], uint16(len(fragment)-40))
+		fragments[i] = fragment
+	}
+	return fragments, nil
+}
+
+// tcpResegmenter 将 TCP payload 按照 sizes 依次切分为多个 segment, sizes 循环使用, 每个 segment 与前一个重叠 overlap 字节
+// 每个 segment 保留原始的 TCP 选项, FIN / PSH 只保留在最后一个 segment 上; 带有 SYN / RST / URG 的 segment 保持不变
+type tcpResegmenter struct {
+	sizes   []int
+	overlap int
+}
+
+// resegment 返回切分后的以太网帧, 不需要切分时返回 nil
+func (s *tcpResegmenter) resegment(data []byte) ([][]byte, error) {
+	view, ok := parseIPPacketView(data)
+	if !ok || view.protocol != layers.IPProtocolTCP || view.l4Offset < 0 || view.l4Offset+20 > len(data) {
+		return nil, nil
+	}
+	l4 := view.l4Offset
+	if flags := data[l4+13]; flags&0x26 != 0 { // SYN, RST, URG
+		return nil, nil
+	}
+	headerEnd := l4 + int(data[l4+12]>>4)*4
+	end := view.ipOffset + len(ipDatagram(data[view.ipOffset:]))
+	if headerEnd < l4+20 || headerEnd > end {
+		return nil, fmt.Errorf("invalid tcp data offset")
+	}
+	payload := data[headerEnd:end]
+	if len(payload) <= s.sizes[0] {
+		return nil, nil
+	}
+
+	seq := binary.BigEndian.Uint32(data[l4+4:])
+	flags := data[l4+13]
+	ranges := splitRanges(len(payload), s.sizes, s.overlap)
+	frames := make([][]byte, len(ranges))
+	for i, r := range ranges {
+		frame := make([]byte, 0, headerEnd+r[1]-r[0])
+		frame = append(append(frame, data[:headerEnd]...), payload[r[0]:r[1]]...)
+
+		binary.BigEndian.PutUint32(frame[l4+4:], seq+uint32(r[0]))
+		if i < len(ranges)-1 {
+			frame[l4+13] = flags &^ 0x09 // FIN, PSH
+		}
+
+		ip := frame[view.ipOffset:]
+		if view.version == 4 {
+			ihl := int(ip[0]&0x0f) * 4
+			binary.BigEndian.PutUint16(ip[2:4], uint16(len(ip)))
+			binary.BigEndian.PutUint16(ip[4:6], binary.BigEndian.Uint16(ip[4:6])+uint16(i))
+			binary.BigEndian.PutUint16(ip[10:12], 0)
+			binary.BigEndian.PutUint16(ip[10:12], foldChecksum(onesComplementSum(0, ip[:ihl])))
+		} else {
+			binary.BigEndian.PutUint16(ip[4:6], uint16(len(ip)-40))
+		}
+
+		tcp := frame[l4:]
+		binary.BigEndian.PutUint16(tcp[16:18], 0)
+		binary.BigEndian.PutUint16(tcp[16:18], ipv6Checksum(view.src, view.dst, layers.IPProtocolTCP, tcp))
+		frames[i] = frame
+	}
+	return frames, nil
+}
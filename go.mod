@@ -5,6 +5,7 @@ go 1.14
 require (
 	github.com/google/gopacket v1.1.19
 	github.com/mitchellh/go-homedir v1.1.0
+	github.com/mitchellh/mapstructure v1.4.2
 	github.com/panjf2000/ants/v2 v2.4.2
 	github.com/sirupsen/logrus v1.2.0
 	github.com/spf13/cobra v1.1.3
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/google/gopacket/layers"
+)
+
+// 乱序的范围
+const (
+	reorderScopeFlow   = "flow"   // 只与同一个流中之后的 packet 交换顺序
+	reorderScopeGlobal = "global" // 与之后的任意 packet 交换顺序
+
+	defaultReorderDistance = 3
+
+	// flow 范围内推迟的 packet 所在的流在之后的这么多个 packet 中都没有出现时视为结束, 立即输出,
+	// 避免流结束后 packet 一直推迟到文件末尾
+	reorderFlowIdlePackets = 16
+)
+
+// impairSummary 统计损伤的结果, 在生成每个 variant 后输出
+type impairSummary struct {
+	total      int
+	dropped    int
+	duplicated int
+	jittered   int
+	reordered  int
+}
+
+// recordFlowKey 返回 packet 所属的流, 与方向无关, 非以太网或非 IP 的 packet 返回空字符串
+func recordFlowKey(r *packetRecord) string {
+	if r.linkType != layers.LinkTypeEthernet {
+		return ""
+	}
+	offset, etherType, err := ethernetTypeOffset(r.data)
+	if err != nil {
+		return ""
+	}
+	return undirectedFlowKey(r.data[offset+2:], etherType)
+}
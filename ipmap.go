@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ipMapRule 将 from 网段中的地址映射到 to 网段中, 保留原地址中 to 网段以外的主机位, 与 tcprewrite 的 --pnat 一致
+type ipMapRule struct {
+	from *net.IPNet
+	to   *net.IPNet
+}
+
+// parseIPMapNet 解析网段, 单个地址视为全长掩码
+func parseIPMapNet(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New(fmt.Sprintf("invalid ip: %s", s))
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid cidr: %s", s))
+	}
+	return network, nil
+}
+
+// parseIPMap 解析映射规则, 格式为 from=to, 比如 10.0.0.0/8=172.20.0.0/16 或 192.168.1.10=172.20.1.10
+// 两端必须同为 IPv4 或 IPv6, 同一个网段只能出现一次
+func parseIPMap(rules []string) (*ipMapper, error) {
+	mapper := &ipMapper{}
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New(fmt.Sprintf("invalid ip map rule: %s, must be from=to", rule))
+		}
+		from, err := parseIPMapNet(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseIPMapNet(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if len(from.IP) != len(to.IP) {
+			return nil, errors.New(fmt.Sprintf("invalid ip map rule: %s, both sides must be the same ip version", rule))
+		}
+		if seen[from.String()] {
+			return nil, errors.New(fmt.Sprintf("duplicate ip map rule for %s", from))
+		}
+		seen[from.String()] = true
+		mapper.rules = append(mapper.rules, ipMapRule{from: from, to: to})
+	}
+
+	// 按照掩码从长到短排序, 使得最长前缀优先匹配
+	sort.SliceStable(mapper.rules, func(i, j int) bool {
+		a, _ := mapper.rules[i].from.Mask.Size()
+		b, _ := mapper.rules[j].from.Mask.Size()
+		return a > b
+	})
+	return mapper, nil
+}
+
+// ipMapper 按照最长前缀匹配映射规则, 作用于每个原始地址, 与方向无关
+type ipMapper struct {
+	rules []ipMapRule
+}
+
+// mapIP 返回映射后的地址, 没有匹配的规则时返回 false
+func (m *ipMapper) mapIP(ip net.IP) (net.IP, bool) {
+	if m == nil {
+		return nil, false
+	}
+	for _, rule := range m.rules {
+		if len(rule.from.IP) != len(ip) || !bytes.Equal(ip.Mask(rule.from.Mask), rule.from.IP) {
+			continue
+		}
+		newIP := make(net.IP, len(ip))
+		for i := range ip {
+			newIP[i] = (rule.to.IP[i] & rule.to.Mask[i]) | (ip[i] &^ rule.to.Mask[i])
+		}
+		return newIP, true
+	}
+	return nil, false
+}
@@ -3,8 +3,6 @@ package main
 import (
 	"errors"
 	"fmt"
-	logger "github.com/sirupsen/logrus"
-	"io/ioutil"
 )
 
 var (
@@ -180,44 +178,28 @@ func fastCopyJob(directory string) *Job {
 			},
 			{
 				Name:    "copy modified pcap",
-				Command: fmt.Sprintf("cd %s && mkdir -p {{.RelativeDirectory}} && cp -f {{.Path}} {{.RelativeDirectory}}", directory),
+				Command: fmt.Sprintf("cd %s && mkdir -p {{.RelativeDirectory}} && cp -f {{.Path}} {{if .MalformedPath}}{{.MalformedPath}} {{end}}{{.RelativeDirectory}}", directory),
 			},
 		},
 		FinderId: defaultFinder.Id,
 	}
 }
 
+// fastMergeJob 的合并方式及放大参数来自全局配置
 func fastMergeJob(pcapPath string) *Job {
-
-	directory, err := ioutil.TempDir("/data/", "prsdata-fast-merge-")
-	if err != nil {
-		logger.Errorln(fmt.Sprintf("error when create temporary directory for fast merge: %s", err))
-		terminate()
-	}
-
 	return &Job{
 		Id:     "fast-merge",
 		Name:   "fast-merge",
 		Enable: false,
 		Commands: []*Command{
 			{
-				Name:    "create temporary dir",
-				Type:    "shell",
-				Command: fmt.Sprintf("mkdir -p %s", directory),
-			},
-			{
-				Name:    "copy modified pcap",
-				Command: fmt.Sprintf("cd %s && mkdir -p {{.RelativeDirectory}} && cp -f {{.Path}} {{.RelativeDirectory}}", directory),
-			},
-			{
-				Name:    "merge pcap",
-				Type:    "shell",
-				Command: fmt.Sprintf("find %s -type f | xargs %s -w %s", directory, pcapTool.MergeCap, pcapPath),
-			},
-			{
-				Name:    "delete temporary dir",
-				Type:    "shell",
-				Command: fmt.Sprintf("rm -rf %s", directory),
+				Name:          "merge modified pcap",
+				Type:          "merge",
+				Command:       pcapPath,
+				MergeMode:     config.MergeMode,
+				MergeOffset:   config.MergeOffset,
+				Amplify:       config.Amplify,
+				AmplifySpread: config.AmplifySpread,
 			},
 		},
 		FinderId: defaultFinder.Id,
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+)
+
+// parseMacOui 解析 3 字节的 OUI, 比如 00:16:3e, 为空时返回 nil
+func parseMacOui(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	// 补齐为完整的 MAC 地址后使用标准库解析
+	mac, err := net.ParseMAC(s + ":00:00:00")
+	if err != nil || len(mac) != 6 {
+		return nil, errors.New(fmt.Sprintf("%s is not a valid OUI", s))
+	}
+	if mac[0]&1 != 0 {
+		return nil, errors.New(fmt.Sprintf("%s is a multicast OUI", s))
+	}
+	return mac[:3], nil
+}
+
+// parseMacPool 解析 MAC 地址池, 地址不能重复, 也不能是组播地址
+func parseMacPool(pool []string) ([]net.HardwareAddr, error) {
+	var macs []net.HardwareAddr
+	seen := make(map[string]bool)
+	for _, s := range pool {
+		mac, err := net.ParseMAC(s)
+		if err != nil || len(mac) != 6 {
+			return nil, errors.New(fmt.Sprintf("%s is not a valid MAC address", s))
+		}
+		if mac[0]&1 != 0 {
+			return nil, errors.New(fmt.Sprintf("%s is a multicast MAC address", s))
+		}
+		if seen[string(mac)] {
+			return nil, errors.New(fmt.Sprintf("duplicate MAC address %s", s))
+		}
+		seen[string(mac)] = true
+		macs = append(macs, mac)
+	}
+	return macs, nil
+}
+
+// macRewriter 按照 IP 地址改写以太网帧的 MAC 地址, 同一个 IP 总是对应同一个 MAC, 不同的 IP 对应不同的 MAC
+// 配置了地址池时按照 IP 首次出现的顺序依次分配, 否则在 OUI 下随机生成, 未指定 OUI 时生成本地管理的地址
+// 广播和组播地址保持不变
+type macRewriter struct {
+	oui  []byte
+	pool []net.HardwareAddr
+	rand *rand.Rand
+
+	next    int // 下一个待分配地址在地址池中的序号
+	mapping map[string]net.HardwareAddr
+	used    map[string]bool
+}
+
+func newMacRewriter(oui []byte, pool []net.HardwareAddr, r *rand.Rand) *macRewriter {
+	return &macRewriter{
+		oui:     oui,
+		pool:    pool,
+		rand:    r,
+		mapping: make(map[string]net.HardwareAddr),
+		used:    make(map[string]bool),
+	}
+}
+
+// macFor 返回 IP 地址对应的 MAC 地址, 地址池耗尽时返回错误
+func (m *macRewriter) macFor(ip []byte) (net.HardwareAddr, error) {
+	if mac, ok := m.mapping[string(ip)]; ok {
+		return mac, nil
+	}
+
+	var mac net.HardwareAddr
+	if len(m.pool) > 0 {
+		if m.next >= len(m.pool) {
+			return nil, fmt.Errorf("mac pool exhausted (%d addresses)", len(m.pool))
+		}
+		mac = m.pool[m.next]
+		m.next++
+	} else {
+		mac = make(net.HardwareAddr, 6)
+		for {
+			m.rand.Read(mac)
+			if m.oui != nil {
+				copy(mac, m.oui)
+			} else {
+				mac[0] = mac[0]&0xfc | 0x02 // 本地管理的单播地址
+			}
+			if !m.used[string(mac)] {
+				break
+			}
+		}
+	}
+
+	m.used[string(mac)] = true
+	m.mapping[string(ip)] = mac
+	return mac, nil
+}
+
+// rewrite 原地改写以太网帧的源和目的 MAC 地址, 非 IP packet 返回错误
+func (m *macRewriter) rewrite(data []byte) error {
+	view, ok := parseIPPacketView(data)
+	if !ok {
+		return fmt.Errorf("not an IP packet")
+	}
+
+	src, err := m.macFor(view.src)
+	if err != nil {
+		return err
+	}
+	dst, err := m.macFor(view.dst)
+	if err != nil {
+		return err
+	}
+
+	if data[6]&1 == 0 {
+		copy(data[6:12], src)
+	}
+	if data[0]&1 == 0 {
+		copy(data[0:6], dst)
+	}
+	return nil
+}
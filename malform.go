@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// 首部损坏的类型
+const (
+	malformIPHeaderLength   = "ip_header_length"  // IPv4 首部长度小于 20 或超出实际长度
+	malformTCPDataOffset    = "tcp_data_offset"   // TCP 首部长度小于 20 或超出实际长度
+	malformChecksum         = "checksum"          // IPv4 首部或者 TCP / UDP / ICMP 校验和错误
+	malformTruncatedOptions = "truncated_options" // TCP 选项的长度超出首部
+	malformTCPFlags         = "tcp_flags"         // 不可能出现的 TCP 标志位组合
+
+	malformAll = "all"
+
+	defaultMalformRate = 0.01
+)
+
+var malformKinds = []string{malformIPHeaderLength, malformTCPDataOffset, malformChecksum, malformTruncatedOptions, malformTCPFlags}
+
+// 不可能出现的 TCP 标志位组合: SYN+FIN, SYN+RST, FIN+RST, 全部置位, 全部清零
+var malformTCPFlagSets = []byte{0x03, 0x06, 0x05, 0x3f, 0x00}
+
+// parseMalformKinds 检查并展开损坏类型, all 表示全部类型
+func parseMalformKinds(kinds []string) ([]string, error) {
+	var parsed []string
+	for _, kind := range kinds {
+		if kind == malformAll {
+			return malformKinds, nil
+		}
+		valid := false
+		for _, k := range malformKinds {
+			if kind == k {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, errors.New(fmt.Sprintf("invalid malform kind: %s, must be one of %s, %s", kind, strings.Join(malformKinds, ", "), malformAll))
+		}
+		parsed = append(parsed, kind)
+	}
+	return parsed, nil
+}
+
+// malformedRecordPath 返回记录损坏 packet 的文件路径, 与生成的 pcap 放在一起
+func malformedRecordPath(pcapPath string) string {
+	return pcapPath + ".malformed.jsonl"
+}
+
+// malformRecord 记录一个被损坏的 packet, 每行一个 JSON 对象
+type malformRecord struct {
+	Frame  int    `json:"frame"` // 在生成的 pcap 中的序号, 从 1 开始, 与 wireshark 的 frame number 一致
+	Index  int    `json:"index"` // 在源文件中的序号, 从 0 开始
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+func saveMalformRecords(path string, records []malformRecord) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot create malformed record file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// headerMalformer 原地损坏以太网帧中的 IP / TCP 首部
+type headerMalformer struct {
+	kinds []string
+	rand  *rand.Rand
+}
+
+// malform 从适用于该 packet 的类型中随机选择一种进行损坏, 没有适用的类型时返回 false
+// 除了 checksum 类型以外, 校验和都会随之增量修正, 使得被损坏的只有指定的字段
+func (m *headerMalformer) malform(data []byte) (kind string, detail string, ok bool) {
+	view, ok := parseIPPacketView(data)
+	if !ok {
+		return "", "", false
+	}
+
+	var applicable []string
+	for _, k := range m.kinds {
+		if m.applicable(k, data, view) {
+			applicable = append(applicable, k)
+		}
+	}
+	if len(applicable) == 0 {
+		return "", "", false
+	}
+
+	kind = applicable[m.rand.Intn(len(applicable))]
+	switch kind {
+	case malformIPHeaderLength:
+		detail = m.malformIPHeaderLength(data, view)
+	case malformTCPDataOffset:
+		detail = m.malformTCPDataOffset(data, view)
+	case malformChecksum:
+		detail = m.malformChecksum(data, view)
+	case malformTruncatedOptions:
+		detail = m.malformTruncatedOptions(data, view)
+	case malformTCPFlags:
+		detail = m.malformTCPFlags(data, view)
+	}
+	return kind, detail, true
+}
+
+func (m *headerMalformer) applicable(kind string, data []byte, view *ipPacketView) bool {
+	isTCP := view.protocol == layers.IPProtocolTCP && view.l4Offset >= 0 && view.l4Offset+20 <= len(data)
+	switch kind {
+	case malformIPHeaderLength:
+		return view.version == 4
+	case malformTCPDataOffset, malformTCPFlags:
+		return isTCP
+	case malformChecksum:
+		return view.version == 4 || l4ChecksumPosition(data, view) >= 0
+	case malformTruncatedOptions:
+		return isTCP && tcpOptionLengthPosition(data, view.l4Offset) >= 0
+	}
+	return false
+}
+
+// l4ChecksumPosition 返回 TCP / UDP / ICMP 校验和的位置, 不存在时返回 -1
+func l4ChecksumPosition(data []byte, view *ipPacketView) int {
+	if pos := view.l4ChecksumOffset(len(data)); pos >= 0 {
+		return pos
+	}
+	if view.protocol == layers.IPProtocolICMPv4 && view.l4Offset >= 0 && view.l4Offset+4 <= len(data) {
+		return view.l4Offset + 2
+	}
+	return -1
+}
+
+// tcpOptionLengthPosition 返回第一个带有长度字段的 TCP 选项的长度字段位置, 不存在时返回 -1
+func tcpOptionLengthPosition(data []byte, l4Offset int) int {
+	end := l4Offset + int(data[l4Offset+12]>>4)*4
+	if end > len(data) {
+		end = len(data)
+	}
+	for pos := l4Offset + 20; pos+1 < end; {
+		switch layers.TCPOptionKind(data[pos]) {
+		case layers.TCPOptionKindEndList:
+			return -1
+		case layers.TCPOptionKindNop:
+			pos++
+		default:
+			if data[pos+1] < 2 {
+				return -1
+			}
+			return pos + 1
+		}
+	}
+	return -1
+}
+
+// setHeaderByte 修改 data[pos] 并增量修正 csum 处的校验和, base 为校验和覆盖范围的起点, 用于对齐 16 位字
+func setHeaderByte(data []byte, pos int, value byte, base int, csum int) {
+	word := pos - (pos-base)%2
+	if csum < 0 || word+2 > len(data) {
+		data[pos] = value
+		return
+	}
+	old := []byte{data[word], data[word+1]}
+	data[pos] = value
+	updateChecksum(data, csum, old, data[word:word+2])
+}
+
+// badHeaderLength 返回一个与 current 不同的非法首部长度 (以 4 字节为单位): 小于 5, 或者最大值 15
+func (m *headerMalformer) badHeaderLength(current byte) byte {
+	if current != 15 && m.rand.Intn(2) == 0 {
+		return 15
+	}
+	for {
+		if bad := byte(m.rand.Intn(5)); bad != current {
+			return bad
+		}
+	}
+}
+
+func (m *headerMalformer) malformIPHeaderLength(data []byte, view *ipPacketView) string {
+	pos := view.ipOffset
+	ihl := data[pos] & 0x0f
+	bad := m.badHeaderLength(ihl)
+	setHeaderByte(data, pos, data[pos]&0xf0|bad, pos, pos+10)
+	return fmt.Sprintf("ip header length %d -> %d", int(ihl)*4, int(bad)*4)
+}
+
+func (m *headerMalformer) malformTCPDataOffset(data []byte, view *ipPacketView) string {
+	pos := view.l4Offset + 12
+	offset := data[pos] >> 4
+	bad := m.badHeaderLength(offset)
+	setHeaderByte(data, pos, bad<<4|data[pos]&0x0f, view.l4Offset, l4ChecksumPosition(data, view))
+	return fmt.Sprintf("tcp data offset %d -> %d", int(offset)*4, int(bad)*4)
+}
+
+func (m *headerMalformer) malformChecksum(data []byte, view *ipPacketView) string {
+	var candidates []int
+	if view.version == 4 {
+		candidates = append(candidates, view.ipOffset+10)
+	}
+	if pos := l4ChecksumPosition(data, view); pos >= 0 {
+		candidates = append(candidates, pos)
+	}
+
+	pos := candidates[m.rand.Intn(len(candidates))]
+	name := fmt.Sprintf("%s checksum", strings.ToLower(view.protocol.String()))
+	if pos == view.ipOffset+10 {
+		name = "ip header checksum"
+	}
+
+	old := binary.BigEndian.Uint16(data[pos:])
+	bad := old ^ uint16(1+m.rand.Intn(0xffff))
+	binary.BigEndian.PutUint16(data[pos:], bad)
+	return fmt.Sprintf("%s 0x%04x -> 0x%04x", name, old, bad)
+}
+
+func (m *headerMalformer) malformTruncatedOptions(data []byte, view *ipPacketView) string {
+	pos := tcpOptionLengthPosition(data, view.l4Offset)
+	end := view.l4Offset + int(data[view.l4Offset+12]>>4)*4
+
+	// 长度超出首部剩余的字节数
+	length := data[pos]
+	bad := end - pos + 2 + m.rand.Intn(8)
+	if bad > 255 {
+		bad = 255
+	}
+	setHeaderByte(data, pos, byte(bad), view.l4Offset, l4ChecksumPosition(data, view))
+	return fmt.Sprintf("tcp option %d length %d -> %d", data[pos-1], length, bad)
+}
+
+func (m *headerMalformer) malformTCPFlags(data []byte, view *ipPacketView) string {
+	pos := view.l4Offset + 13
+	flags := data[pos]
+	// 保留 ECE / CWR, 重新选择直到与原来的标志位不同
+	bad := flags
+	for bad == flags {
+		bad = malformTCPFlagSets[m.rand.Intn(len(malformTCPFlagSets))] | flags&0xc0
+	}
+	setHeaderByte(data, pos, bad, view.l4Offset, l4ChecksumPosition(data, view))
+	return fmt.Sprintf("tcp flags 0x%02x -> 0x%02x", flags, bad)
+}
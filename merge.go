@@ -0,0 +1,445 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	logger "github.com/sirupsen/logrus"
+)
+
+// 合并方式
+const (
+	mergeInterleave = "interleave" // 按照时间戳交错合并, 第 i 个 pcap 的 variant 整体后移 i 个 offset, 放大的 variant 再依次错开
+	mergeConcat     = "concat"     // 依次拼接, 每个 variant 的第一个 packet 紧随上一个 variant 的最后一个 packet, 间隔 offset
+)
+
+func checkMergeMode(mode string) error {
+	if mode != mergeInterleave && mode != mergeConcat {
+		return errors.New(fmt.Sprintf("invalid merge mode: %s, must be %s or %s", mode, mergeInterleave, mergeConcat))
+	}
+	return nil
+}
+
+// pcapMerger 收集 merge 命令为每个 pcap 生成的 variant, 全部生成后合并写出到 path
+// variant 按照 pcap 在 finder 中的顺序排列, 合并结果与生成的先后顺序无关; 以 .pcapng 结尾时写出 pcapng, 否则写出 pcap
+// 放大时每个 pcap 生成 amplify 个 variant, interleave 下第 k 个 variant 后移 k * spread / amplify
+type pcapMerger struct {
+	path    string
+	mode    string
+	offset  time.Duration
+	amplify int
+	spread  time.Duration
+
+	lock      sync.Mutex
+	variants  []string
+	temporary []string // 分批合并时生成的中间文件
+}
+
+func newPcapMerger(command *Command, pcaps int) *pcapMerger {
+	return &pcapMerger{
+		path:     command.Command,
+		mode:     command.MergeMode,
+		offset:   command.MergeOffset,
+		amplify:  command.Amplify,
+		spread:   command.AmplifySpread,
+		variants: make([]string, pcaps*command.Amplify),
+	}
+}
+
+// add 记录第 index 个 pcap 的第 amplifyIndex 个 variant, 可并发调用
+func (m *pcapMerger) add(index, amplifyIndex int, path string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.variants[index*m.amplify+amplifyIndex] = path
+}
+
+// shift 返回 interleave 时第 i 个 variant 的时间偏移
+func (m *pcapMerger) shift(i int) time.Duration {
+	index, amplifyIndex := i/m.amplify, i%m.amplify
+	return time.Duration(index)*m.offset + m.spread*time.Duration(amplifyIndex)/time.Duration(m.amplify)
+}
+
+// mergeBatchSize 为同时打开的 variant 数量上限, 超出时先分批交错合并为中间文件, 避免打开的文件过多
+const mergeBatchSize = 64
+
+// run 合并所有已生成的 variant, 每个 variant 读取完毕后立即删除
+func (m *pcapMerger) run(realJob *RealJob, command *Command) {
+	var err error
+	defer func() {
+		// 合并成功时所有 variant 和中间文件都已在读取完后删除, 失败时删除剩余的
+		if err == nil {
+			return
+		}
+		for _, variant := range append(m.variants, m.temporary...) {
+			if variant != "" {
+				deleteFile(variant)
+			}
+		}
+	}()
+
+	start := time.Now()
+	var sources, packets int
+	sources, packets, err = m.merge()
+	duration := time.Now().Sub(start)
+	if err != nil {
+		logger.Errorln(fmt.Sprintf("%s %s merge into %s failed, use: %s, err is: %s", realJob, command, m.path, duration, err))
+		return
+	}
+	logger.Infoln(fmt.Sprintf("%s %s merged %d packets from %d variants into %s, use: %s", realJob, command, packets, sources, m.path, duration))
+}
+
+// mergeInput 是一个待合并的文件, shift 为 interleave 时的时间偏移
+type mergeInput struct {
+	path  string
+	shift time.Duration
+}
+
+// mergeSource 是一个正在合并的文件, packet 为下一个待写出的 packet, 时间戳已经加上 shift
+type mergeSource struct {
+	index  int
+	path   string
+	file   *os.File
+	reader pcapReader
+	shift  time.Duration
+
+	data []byte
+	ci   gopacket.CaptureInfo
+	eof  bool
+}
+
+func openMergeSource(index int, input mergeInput) (*mergeSource, error) {
+	file, err := os.Open(input.path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file %s: %w", input.path, err)
+	}
+	reader, _, err := newPcapReader(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("cannot read %s: %w", input.path, err)
+	}
+	return &mergeSource{index: index, path: input.path, file: file, reader: reader, shift: input.shift}, nil
+}
+
+// next 读取下一个 packet, 读取完毕时关闭并删除文件
+func (s *mergeSource) next() error {
+	data, ci, err := s.reader.ReadPacketData()
+	if err == io.EOF {
+		s.eof = true
+		_ = s.file.Close()
+		deleteFile(s.path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error when read packet from %s: %w", s.path, err)
+	}
+	ci.Timestamp = ci.Timestamp.Add(s.shift)
+	s.data, s.ci = data, ci
+	return nil
+}
+
+// mergeHeap 按照时间戳排序, 时间戳相同时按照 variant 的顺序
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if !h[i].ci.Timestamp.Equal(h[j].ci.Timestamp) {
+		return h[i].ci.Timestamp.Before(h[j].ci.Timestamp)
+	}
+	return h[i].index < h[j].index
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeSource)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+// merge 返回合并的 variant 数量和写出的 packet 数量
+func (m *pcapMerger) merge() (int, int, error) {
+	var inputs []mergeInput
+	for i, variant := range m.variants {
+		if variant == "" { // 生成失败
+			continue
+		}
+		input := mergeInput{path: variant}
+		if m.mode == mergeInterleave {
+			input.shift = m.shift(i)
+		}
+		inputs = append(inputs, input)
+	}
+	if len(inputs) == 0 {
+		return 0, 0, fmt.Errorf("no pcap generated")
+	}
+	header, err := probeMergeHeader(inputs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.path), os.ModePerm); err != nil {
+		return 0, 0, fmt.Errorf("cannot create directory for %s: %w", m.path, err)
+	}
+	file, err := os.Create(m.path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot create file %s: %w", m.path, err)
+	}
+	defer file.Close()
+
+	writer, err := newMergeWriter(file, header, strings.EqualFold(filepath.Ext(m.path), ".pcapng"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if m.mode == mergeConcat {
+		err = m.concat(inputs, writer)
+	} else {
+		err = m.interleave(inputs, header, writer)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if err = writer.flush(); err != nil {
+		return 0, 0, fmt.Errorf("error when flush %s: %w", m.path, err)
+	}
+	return len(inputs), writer.count, nil
+}
+
+// interleave 每次最多打开 mergeBatchSize 个文件, 超出时每批先合并为一个中间文件, 直到可以一次合并完成
+// 每批包含连续的 variant, 因此时间戳相同的 packet 仍然按照 variant 的顺序写出
+func (m *pcapMerger) interleave(inputs []mergeInput, header mergeHeader, writer *mergeWriter) error {
+	for len(inputs) > mergeBatchSize {
+		var merged []mergeInput
+		for start := 0; start < len(inputs); start += mergeBatchSize {
+			end := start + mergeBatchSize
+			if end > len(inputs) {
+				end = len(inputs)
+			}
+			input, err := m.interleaveBatch(inputs[start:end], header)
+			if err != nil {
+				return err
+			}
+			merged = append(merged, input)
+		}
+		inputs = merged
+	}
+	return interleaveInputs(inputs, writer)
+}
+
+// interleaveBatch 将一批文件交错合并为一个纳秒精度的 pcapng 中间文件, 中间文件在使用后删除
+func (m *pcapMerger) interleaveBatch(inputs []mergeInput, header mergeHeader) (mergeInput, error) {
+	file, err := ioutil.TempFile(filepath.Dir(inputs[0].path), "merge-*.pcapng")
+	if err != nil {
+		return mergeInput{}, fmt.Errorf("cannot create temporary file: %w", err)
+	}
+	defer file.Close()
+	m.temporary = append(m.temporary, file.Name())
+
+	header.nanosecond = true
+	writer, err := newMergeWriter(file, header, true)
+	if err != nil {
+		return mergeInput{}, err
+	}
+	if err = interleaveInputs(inputs, writer); err != nil {
+		return mergeInput{}, err
+	}
+	if err = writer.flush(); err != nil {
+		return mergeInput{}, fmt.Errorf("error when flush %s: %w", file.Name(), err)
+	}
+	return mergeInput{path: file.Name()}, nil
+}
+
+func interleaveInputs(inputs []mergeInput, writer *mergeWriter) error {
+	h := make(mergeHeap, 0, len(inputs))
+	defer func() {
+		for _, s := range h {
+			_ = s.file.Close()
+		}
+	}()
+	for i, input := range inputs {
+		s, err := openMergeSource(i, input)
+		if err != nil {
+			return err
+		}
+		if err = s.next(); err != nil {
+			_ = s.file.Close()
+			return err
+		}
+		if !s.eof {
+			h = append(h, s)
+		}
+	}
+	heap.Init(&h)
+
+	for h.Len() > 0 {
+		s := h[0]
+		if err := writer.write(s); err != nil {
+			return err
+		}
+		if err := s.next(); err != nil {
+			return err
+		}
+		if s.eof {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return nil
+}
+
+// concat 依次打开每个文件, 同一时间只打开一个
+func (m *pcapMerger) concat(inputs []mergeInput, writer *mergeWriter) error {
+	var end time.Time // 已写出的最大时间戳
+	for i, input := range inputs {
+		s, err := openMergeSource(i, input)
+		if err != nil {
+			return err
+		}
+		err = m.concatSource(s, &end, writer)
+		_ = s.file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *pcapMerger) concatSource(s *mergeSource, end *time.Time, writer *mergeWriter) error {
+	if err := s.next(); err != nil {
+		return err
+	}
+	if !s.eof && !end.IsZero() {
+		s.shift = end.Add(m.offset).Sub(s.ci.Timestamp)
+		s.ci.Timestamp = s.ci.Timestamp.Add(s.shift)
+	}
+	for !s.eof {
+		if s.ci.Timestamp.After(*end) {
+			*end = s.ci.Timestamp
+		}
+		if err := writer.write(s); err != nil {
+			return err
+		}
+		if err := s.next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeHeader 是写出合并结果所需的文件信息, 由所有 variant 的文件头决定
+type mergeHeader struct {
+	linkType   layers.LinkType // 第一个 variant 的 link type
+	snaplen    uint32
+	nanosecond bool
+}
+
+// probeMergeHeader 依次读取每个文件的文件头, 同一时间只打开一个文件
+func probeMergeHeader(inputs []mergeInput) (mergeHeader, error) {
+	var header mergeHeader
+	for i, input := range inputs {
+		file, err := os.Open(input.path)
+		if err != nil {
+			return header, fmt.Errorf("cannot open file %s: %w", input.path, err)
+		}
+		reader, format, err := newPcapReader(file)
+		if err != nil {
+			_ = file.Close()
+			return header, fmt.Errorf("cannot read %s: %w", input.path, err)
+		}
+		if i == 0 {
+			header.linkType = reader.LinkType()
+		}
+		if snaplen := readerSnaplen(reader); snaplen > header.snaplen {
+			header.snaplen = snaplen
+		}
+		header.nanosecond = header.nanosecond || format.nanosecond || format.pcapNg
+		_ = file.Close()
+	}
+	return header, nil
+}
+
+// mergeWriter 写出合并后的 packet
+// pcap 只能有一个 link type, 因此所有 variant 的 link type 必须一致; pcapng 为每个 link type 生成一个 interface
+type mergeWriter struct {
+	pcap       *pcapgo.Writer
+	linkType   layers.LinkType
+	ng         *pcapngWriter
+	interfaces map[layers.LinkType]int
+	snaplen    uint32
+	count      int
+}
+
+func newMergeWriter(w io.Writer, header mergeHeader, pcapNg bool) (*mergeWriter, error) {
+	writer := &mergeWriter{linkType: header.linkType, snaplen: header.snaplen}
+
+	if pcapNg {
+		writer.ng = newPcapngWriter(w)
+		writer.interfaces = make(map[layers.LinkType]int)
+		if err := writer.ng.writeSectionHeader(); err != nil {
+			return nil, fmt.Errorf("cannot build pcapng writer: %w", err)
+		}
+		return writer, nil
+	}
+
+	if header.nanosecond {
+		writer.pcap = pcapgo.NewWriterNanos(w)
+	} else {
+		writer.pcap = pcapgo.NewWriter(w)
+	}
+	if err := writer.pcap.WriteFileHeader(writer.snaplen, writer.linkType); err != nil {
+		return nil, fmt.Errorf("cannot build pcap writer (error when write file header): %w", err)
+	}
+	return writer, nil
+}
+
+func (w *mergeWriter) write(s *mergeSource) error {
+	linkType := packetLinkType(s.ci, s.reader.LinkType())
+	ci := s.ci
+
+	if w.ng == nil {
+		if linkType != w.linkType {
+			return fmt.Errorf("found packet with link type %s, which differs from %s, merge into a .pcapng file instead",
+				linkType, w.linkType)
+		}
+		if err := w.pcap.WritePacket(ci, s.data); err != nil {
+			return fmt.Errorf("error when write packet: %w", err)
+		}
+		w.count++
+		return nil
+	}
+
+	// interface 在第一次出现该 link type 时生成
+	index, ok := w.interfaces[linkType]
+	if !ok {
+		var err error
+		if index, err = w.ng.writeInterface(linkType, w.snaplen); err != nil {
+			return fmt.Errorf("error when write pcapng interface: %w", err)
+		}
+		w.interfaces[linkType] = index
+	}
+	ci.InterfaceIndex = index
+	if err := w.ng.WritePacket(ci, s.data); err != nil {
+		return fmt.Errorf("error when write packet: %w", err)
+	}
+	w.count++
+	return nil
+}
+
+func (w *mergeWriter) flush() error {
+	if w.ng != nil {
+		return w.ng.Flush()
+	}
+	return nil
+}
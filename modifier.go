@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"net"
 	"strconv"
 	"strings"
 	"time"
@@ -21,6 +22,28 @@ type Modifier struct {
 	AdjustTime bool          `mapstructure:"adjust_time"`
 	TimeOffset time.Duration `mapstructure:"time_offset"`
 
+	// 重新计算时间戳, 三者最多指定一个: TimeScale 将 packet 之间的时间间隔乘以该倍数, 比如 0.1 表示快 10 倍;
+	// TargetPps / TargetBps 按照指定的 packets/s 或 bits/s 匀速发送, 以第一个 packet 的时间为起点
+	TimeScale float64 `mapstructure:"time_scale"`
+	TargetPps float64 `mapstructure:"target_pps"`
+	TargetBps float64 `mapstructure:"target_bps"`
+
+	// 将超过 FragmentMtu 的 IP packet 分片, 0 表示不分片, FragmentOrder 为分片的输出顺序: in_order / reverse / random / overlap
+	FragmentMtu   int    `mapstructure:"fragment_mtu"`
+	FragmentOrder string `mapstructure:"fragment_order"`
+	// 将 TCP payload 依次按照 Resegment 中的长度切分, 循环使用, 每个 segment 与前一个重叠 ResegmentOverlap 字节
+	Resegment        []int `mapstructure:"resegment"`
+	ResegmentOverlap int   `mapstructure:"resegment_overlap"`
+
+	// 网络损伤: 丢弃和重复 packet 的概率, 时间戳增加 [0, Jitter] 的随机延迟,
+	// 以 ReorderRate 的概率将 packet 推迟到之后的 1 到 ReorderDistance 个 packet 后, ReorderScope 为 flow 时只计算同一个流中的 packet
+	DropRate        float64       `mapstructure:"drop_rate"`
+	DuplicateRate   float64       `mapstructure:"duplicate_rate"`
+	Jitter          time.Duration `mapstructure:"jitter"`
+	ReorderRate     float64       `mapstructure:"reorder_rate"`
+	ReorderDistance int           `mapstructure:"reorder_distance"`
+	ReorderScope    string        `mapstructure:"reorder_scope"`
+
 	KeepIp   bool `mapstructure:"keep_ip"`
 	C1       int  `mapstructure:"c1"`
 	C2       int  `mapstructure:"c2"`
@@ -33,8 +56,72 @@ type Modifier struct {
 	UsePart3 bool `mapstructure:"use_part_3"`
 	UsePart4 bool `mapstructure:"use_part_4"`
 
+	// IPv6 客户端/服务端的网段, 比如 2001:db8:1::/48, 网段以外的高位随机生成, 保留的主机位数与 IPv4 一致
+	// 为空时将 IPv4 的网段嵌入 P426Prefix 得到
+	Client6 string `mapstructure:"client6"`
+	Server6 string `mapstructure:"server6"`
+
+	client6 *net.IPNet
+	server6 *net.IPNet
+
+	// IP 映射规则, 比如 10.0.0.0/8=172.20.0.0/16 或 192.168.1.10=172.20.1.10, 按照最长前缀匹配每个原始地址,
+	// 保留原地址中目标网段以外的主机位, 未匹配的地址按照 KeepIp / Anonymize / 随机网段处理
+	IpMap []string `mapstructure:"ip_map"`
+
+	ipMap *ipMapper
+
+	// 使用前缀保留的匿名化 (Crypto-PAn) 代替随机网段改写 IP, 不能与 KeepIp 同时使用
+	// AnonymizeKey 为 64 位十六进制字符串时直接作为密钥, 否则取其 SHA-256, 为空时由种子生成, 同一次运行中的所有 pcap 使用同一个密钥
+	Anonymize    bool   `mapstructure:"anonymize"`
+	AnonymizeKey string `mapstructure:"anonymize_key"`
+
 	// 尝试将 IPv4 转换为 IPv6
 	P426 bool
+	// IPv4 地址按照 RFC 6052 嵌入该 prefix, 比如 NAT64 的 64:ff9b::/96
+	P426Prefix string `mapstructure:"p426_prefix"`
+
+	// 尝试将 IPv6 转换为 IPv4, 与 P426 互斥, 嵌入了 P426Prefix 的地址直接还原, 其余地址映射到 P624Pool 中
+	P624     bool   `mapstructure:"p624"`
+	P624Pool string `mapstructure:"p624_pool"`
+
+	// 端口映射, 比如 80: 8080 或 tcp/80: 8080, 不指定协议时同时作用于 TCP 和 UDP
+	PortMap map[string]string `mapstructure:"port_map"`
+	// 将客户端端口随机改写为临时端口, 同一个流中保持一致
+	RandomClientPort bool `mapstructure:"random_client_port"`
+
+	portMap map[portKey]uint16
+
+	// 弹出所有 VLAN 标签 / MPLS label, 先于压入执行
+	PopVlan bool `mapstructure:"pop_vlan"`
+	PopMpls bool `mapstructure:"pop_mpls"`
+	// 压入的 VLAN ID / MPLS label, 外层在前, 0 表示按流随机生成, 两层及以上的 VLAN 标签使用 QinQ
+	PushVlan []int `mapstructure:"push_vlan"`
+	PushMpls []int `mapstructure:"push_mpls"`
+
+	// 按照 IP 改写 MAC 地址, 配置了 MacPool 时从中依次分配, 否则在 MacOui 下随机生成, 都未配置时生成本地管理的地址
+	RewriteMac bool     `mapstructure:"rewrite_mac"`
+	MacOui     string   `mapstructure:"mac_oui"`
+	MacPool    []string `mapstructure:"mac_pool"`
+
+	// 将每个帧封装到隧道中: gre / vxlan / geneve / ipip, 为空表示不封装
+	Tunnel    string `mapstructure:"tunnel"`
+	TunnelSrc string `mapstructure:"tunnel_src"`
+	TunnelDst string `mapstructure:"tunnel_dst"`
+	// VXLAN / GENEVE 的 VNI, GRE 的 key (0 表示不带 key)
+	TunnelKey uint32 `mapstructure:"tunnel_key"`
+	// VXLAN / GENEVE 的 UDP 目的端口, 0 表示使用标准端口
+	TunnelPort int `mapstructure:"tunnel_port"`
+	// 先还原输入中的隧道 packet (GRE / VXLAN / GENEVE / IP-in-IP), 再进行其他修改
+	Decap bool `mapstructure:"decap"`
+
+	tunnelSrc net.IP
+	tunnelDst net.IP
+
+	macOui  []byte
+	macPool []net.HardwareAddr
+
+	p426Prefix *net.IPNet
+	p624Pool   *net.IPNet
 	// 大于 0 表示开启 payload shuffle，保留指定数量的字节不打乱
 	ShufflePayload int    `mapstructure:"shuffle_payload"`
 	ShufflePacket  string `mapstructure:"shuffle_packet"`
@@ -43,8 +130,33 @@ type Modifier struct {
 	shufflePacketN int  // 保留前 n 个
 	shufflePacketM int  // 保留后 m 个
 
+	// payload 变异策略: random_fill / zero_fill / bit_flip / insert / delete / dictionary, 为空表示不开启
+	Mutate string `mapstructure:"mutate"`
+	// 保留 payload 的前 n 个字节不做修改
+	MutateKeep int `mapstructure:"mutate_keep"`
+	// bit_flip 时为每个字节翻转一位的概率, insert / delete 时为插入 / 删除的字节数占 payload 长度的比例
+	MutateRate float64 `mapstructure:"mutate_rate"`
+	// dictionary 使用的词典文件, 每行一个 token
+	MutateDictionary string `mapstructure:"mutate_dictionary"`
+
+	mutateDictionary [][]byte
+
+	// 首部损坏类型: ip_header_length / tcp_data_offset / checksum / truncated_options / tcp_flags / all, 为空表示不开启
+	Malform []string `mapstructure:"malform"`
+	// 每个 packet 被损坏的概率
+	MalformRate float64 `mapstructure:"malform_rate"`
+
+	malformKinds []string
+
 	TsharkReadFilter string `mapstructure:"tshark_filter"`
 
+	// 按顺序执行的修改步骤, 比如 filter -> anonymize -> fragment -> adjust_time, 同一个步骤可以出现多次,
+	// 指定后只执行其中的步骤, 步骤的参数覆盖 modifier 中的同名配置, 可用的步骤及参数见 modifierSteps
+	Steps []*ModifierStep `mapstructure:"steps"`
+
+	// 随机修改使用的种子, 0 表示使用全局的 --seed
+	Seed int64 `mapstructure:"seed"`
+
 	Used bool // 是否被某个 job 的 command 使用到
 }
 
@@ -66,6 +178,14 @@ func (m *Modifier) check() error {
 		return errors.New(fmt.Sprintf("duplicate modifier id: %s", m.Id))
 	}
 
+	if err := m.checkParams(); err != nil {
+		return err
+	}
+	return m.checkSteps()
+}
+
+// checkParams 检查 modifier 的各项配置, 并解析到对应的私有字段中, steps 中每个步骤合并了参数的 modifier 同样需要检查
+func (m *Modifier) checkParams() error {
 	if m.C1 < 0 || m.C1 > 255 {
 		return errors.New(fmt.Sprintf("invalid c1: %d", m.C1))
 	}
@@ -92,6 +212,82 @@ func (m *Modifier) check() error {
 		return errors.New(fmt.Sprintf("invalid s4: %d", m.S4))
 	}
 
+	if m.P426Prefix == "" {
+		m.P426Prefix = defaultP426Prefix
+	}
+	prefix, err := parseIPv6Prefix(m.P426Prefix)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid p426 prefix: %s", err))
+	}
+	m.p426Prefix = prefix
+
+	if m.client6, err = parseIPv6Range(m.Client6); err != nil {
+		return errors.New(fmt.Sprintf("invalid client6: %s", err))
+	}
+	if m.server6, err = parseIPv6Range(m.Server6); err != nil {
+		return errors.New(fmt.Sprintf("invalid server6: %s", err))
+	}
+
+	ipMap, err := parseIPMap(m.IpMap)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid ip map: %s", err))
+	}
+	m.ipMap = ipMap
+
+	if err := m.checkTiming(); err != nil {
+		return err
+	}
+	if err := m.checkImpair(); err != nil {
+		return err
+	}
+	if err := m.checkFragment(); err != nil {
+		return err
+	}
+
+	if m.Anonymize && m.KeepIp {
+		return errors.New("anonymize and keep_ip can not be used together")
+	}
+
+	if m.P426 && m.P624 {
+		return errors.New("p426 and p624 can not be used together")
+	}
+	if m.P624Pool == "" {
+		m.P624Pool = defaultP624Pool
+	}
+	pool, err := parseIPv4Pool(m.P624Pool)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid p624 pool: %s", err))
+	}
+	m.p624Pool = pool
+
+	portMap, err := parsePortMap(m.PortMap)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid port map: %s", err))
+	}
+	m.portMap = portMap
+
+	if err := checkVlanIds(m.PushVlan); err != nil {
+		return err
+	}
+	if err := checkMplsLabels(m.PushMpls); err != nil {
+		return err
+	}
+
+	if err := m.checkTunnel(); err != nil {
+		return err
+	}
+
+	oui, err := parseMacOui(m.MacOui)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid mac oui: %s", err))
+	}
+	m.macOui = oui
+	macPool, err := parseMacPool(m.MacPool)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid mac pool: %s", err))
+	}
+	m.macPool = macPool
+
 	if m.ShufflePacket == "" || m.ShufflePacket == "false" {
 		m.shufflePacket = false
 	} else if m.ShufflePacket == "true" {
@@ -122,13 +318,64 @@ func (m *Modifier) check() error {
 		m.shufflePacketM = M
 	}
 
+	if err := m.checkMutate(); err != nil {
+		return err
+	}
+
+	kinds, err := parseMalformKinds(m.Malform)
+	if err != nil {
+		return err
+	}
+	m.malformKinds = kinds
+	if m.MalformRate == 0 {
+		m.MalformRate = defaultMalformRate
+	}
+	if m.MalformRate < 0 || m.MalformRate > 1 {
+		return errors.New(fmt.Sprintf("invalid malform rate: %v, must be in (0, 1]", m.MalformRate))
+	}
+
 	return nil
 }
 
-func (m *Modifier) randomEndPoints(hasIPv6 bool) string {
-	s1 := rand.NewSource(time.Now().UnixNano())
-	r1 := rand.New(s1)
+func (m *Modifier) checkMutate() error {
+	if m.Mutate == "" {
+		return nil
+	}
+
+	valid := false
+	for _, strategy := range mutateStrategies {
+		if m.Mutate == strategy {
+			valid = true
+		}
+	}
+	if !valid {
+		return errors.New(fmt.Sprintf("invalid mutate strategy: %s, must be one of %s", m.Mutate, strings.Join(mutateStrategies, ", ")))
+	}
 
+	if m.MutateKeep < 0 {
+		return errors.New(fmt.Sprintf("invalid mutate keep: %d, must be larger than or equal to 0", m.MutateKeep))
+	}
+	if m.MutateRate == 0 {
+		m.MutateRate = defaultMutateRate
+	}
+	if m.MutateRate < 0 || m.MutateRate > 1 {
+		return errors.New(fmt.Sprintf("invalid mutate rate: %v, must be in (0, 1]", m.MutateRate))
+	}
+
+	if m.Mutate == mutateDictionary {
+		if m.MutateDictionary == "" {
+			return errors.New("mutate dictionary is required when mutate strategy is dictionary")
+		}
+		dictionary, err := loadMutateDictionary(m.MutateDictionary)
+		if err != nil {
+			return errors.New(fmt.Sprintf("error when load mutate dictionary: %s", err))
+		}
+		m.mutateDictionary = dictionary
+	}
+	return nil
+}
+
+func (m *Modifier) randomEndPoints(hasIPv6 bool, r1 *rand.Rand) *EndPoints {
 	c3 := r1.Int31n(255)
 	s3 := r1.Int31n(255)
 
@@ -158,11 +405,180 @@ func (m *Modifier) randomEndPoints(hasIPv6 bool) string {
 		s_mask += 16
 	}
 
-	if hasIPv6 {
-		c_mask += 96
-		s_mask += 96
-		return fmt.Sprintf("[0100::ffff:%02x%02x:%02x%02x/%d]:[0100::ffff:%02x%02x:%02x%02x/%d]", m.C1, m.C2, c3, c4, c_mask, m.S1, m.S2, s3, s4, s_mask)
-	} else {
-		return fmt.Sprintf("%d.%d.%d.%d/%d:%d.%d.%d.%d/%d", m.C1, m.C2, c3, c4, c_mask, m.S1, m.S2, s3, s4, s_mask)
+	// IPv4 和 IPv6 同时生成, 混合了两种协议的 pcap 也能全部改写, 未配置 IPv6 网段时由 IPv4 网段嵌入 p426 的 prefix 得到
+	_, client4, _ := net.ParseCIDR(fmt.Sprintf("%d.%d.%d.%d/%d", m.C1, m.C2, c3, c4, c_mask))
+	_, server4, _ := net.ParseCIDR(fmt.Sprintf("%d.%d.%d.%d/%d", m.S1, m.S2, s3, s4, s_mask))
+	translator := newIPv4To6Translator(m.p426Prefix)
+	client6 := translator.embedNet(client4)
+	server6 := translator.embedNet(server4)
+	// 保留的主机位数与 IPv4 一致, 在最后生成, 不影响 IPv4 网段的随机结果
+	if m.client6 != nil {
+		client6 = randomSubnet(m.client6, 128-32+c_mask, r1)
+	}
+	if m.server6 != nil {
+		server6 = randomSubnet(m.server6, 128-32+s_mask, r1)
+	}
+
+	return &EndPoints{
+		client4:    client4,
+		server4:    server4,
+		client6:    client6,
+		server6:    server6,
+		preferIPv6: hasIPv6,
+	}
+}
+
+func (m *Modifier) checkTiming() error {
+	if m.TimeScale < 0 || m.TargetPps < 0 || m.TargetBps < 0 {
+		return errors.New("time_scale, target_pps and target_bps can not be negative")
+	}
+	n := 0
+	for _, v := range []float64{m.TimeScale, m.TargetPps, m.TargetBps} {
+		if v > 0 {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("only one of time_scale, target_pps and target_bps can be used")
+	}
+	return nil
+}
+
+func (m *Modifier) checkFragment() error {
+	if m.FragmentMtu != 0 && m.FragmentMtu < minFragmentMtu {
+		return errors.New(fmt.Sprintf("invalid fragment mtu: %d, must be larger than or equal to %d", m.FragmentMtu, minFragmentMtu))
+	}
+	if m.FragmentOrder == "" {
+		m.FragmentOrder = fragmentInOrder
+	}
+	if err := checkFragmentOrder(m.FragmentOrder); err != nil {
+		return err
+	}
+
+	if m.ResegmentOverlap < 0 {
+		return errors.New(fmt.Sprintf("invalid resegment overlap: %d, must be larger than or equal to 0", m.ResegmentOverlap))
+	}
+	for _, size := range m.Resegment {
+		if size <= m.ResegmentOverlap {
+			return errors.New(fmt.Sprintf("invalid resegment size: %d, must be larger than resegment overlap %d", size, m.ResegmentOverlap))
+		}
+	}
+	return nil
+}
+
+func (m *Modifier) checkImpair() error {
+	rates := []struct {
+		name string
+		rate float64
+	}{{"drop rate", m.DropRate}, {"duplicate rate", m.DuplicateRate}, {"reorder rate", m.ReorderRate}}
+	for _, r := range rates {
+		if r.rate < 0 || r.rate > 1 {
+			return errors.New(fmt.Sprintf("invalid %s: %v, must be in [0, 1]", r.name, r.rate))
+		}
+	}
+	if m.Jitter < 0 {
+		return errors.New(fmt.Sprintf("invalid jitter: %s, must be larger than or equal to 0", m.Jitter))
+	}
+
+	if m.ReorderDistance == 0 {
+		m.ReorderDistance = defaultReorderDistance
+	}
+	if m.ReorderDistance < 0 {
+		return errors.New(fmt.Sprintf("invalid reorder distance: %d, must be larger than 0", m.ReorderDistance))
+	}
+	if m.ReorderScope == "" {
+		m.ReorderScope = reorderScopeFlow
+	}
+	if m.ReorderScope != reorderScopeFlow && m.ReorderScope != reorderScopeGlobal {
+		return errors.New(fmt.Sprintf("invalid reorder scope: %s, must be %s or %s", m.ReorderScope, reorderScopeFlow, reorderScopeGlobal))
+	}
+	return nil
+}
+
+// parseIPv6Range 解析 IPv6 网段, 为空时返回 nil
+func parseIPv6Range(s string) (*net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ip, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		return nil, errors.New(fmt.Sprintf("%s is not an IPv6 range", s))
+	}
+	return network, nil
+}
+
+// randomSubnet 在 network 中随机生成一个掩码长度为 ones 的子网, ones 不超过 network 的掩码长度时返回 network 本身
+func randomSubnet(network *net.IPNet, ones int, r *rand.Rand) *net.IPNet {
+	prefixLen, bits := network.Mask.Size()
+	if ones <= prefixLen {
+		return network
+	}
+	ip := make(net.IP, len(network.IP))
+	r.Read(ip)
+	mask := net.CIDRMask(ones, bits)
+	for i := range ip {
+		ip[i] = network.IP[i] | ip[i]&^network.Mask[i]&mask[i]
+	}
+	return &net.IPNet{IP: ip, Mask: mask}
+}
+
+// anonymizeKey 返回 Crypto-PAn 的密钥, 未指定时由 modifier 的种子 (未指定时使用全局种子) 生成, 与 variant 无关
+func (m *Modifier) anonymizeKey() []byte {
+	if m.AnonymizeKey != "" {
+		return parseAnonymizeKey(m.AnonymizeKey)
+	}
+	base := config.Seed
+	if m.Seed != 0 {
+		base = m.Seed
+	}
+	key := make([]byte, cryptoPAnKeyLen)
+	subRand(base, "anonymize").Read(key)
+	return key
+}
+
+func (m *Modifier) checkTunnel() error {
+	switch m.Tunnel {
+	case "":
+	case tunnelVXLAN, tunnelGENEVE:
+		if m.TunnelKey > 0xffffff {
+			return errors.New(fmt.Sprintf("invalid tunnel key: %d, %s vni is 24 bits", m.TunnelKey, m.Tunnel))
+		}
+	case tunnelGRE, tunnelIPIP:
+	default:
+		return errors.New(fmt.Sprintf("invalid tunnel: %s, must be one of %s, %s, %s, %s", m.Tunnel, tunnelGRE, tunnelVXLAN, tunnelGENEVE, tunnelIPIP))
+	}
+
+	if m.TunnelPort < 0 || m.TunnelPort > 65535 {
+		return errors.New(fmt.Sprintf("invalid tunnel port: %d", m.TunnelPort))
+	}
+
+	if m.TunnelSrc == "" {
+		m.TunnelSrc = defaultTunnelSrc
+	}
+	if m.TunnelDst == "" {
+		m.TunnelDst = defaultTunnelDst
+	}
+	src, dst, err := parseTunnelEndpoints(m.TunnelSrc, m.TunnelDst)
+	if err != nil {
+		return err
+	}
+	m.tunnelSrc, m.tunnelDst = src, dst
+	return nil
+}
+
+// tunnelPorts 返回 VXLAN 和 GENEVE 使用的 UDP 端口, 指定了 TunnelPort 时替换当前隧道类型的端口
+func (m *Modifier) tunnelPorts() (vxlan, geneve uint16) {
+	vxlan, geneve = vxlanPort, genevePort
+	if m.TunnelPort != 0 {
+		switch m.Tunnel {
+		case tunnelVXLAN:
+			vxlan = uint16(m.TunnelPort)
+		case tunnelGENEVE:
+			geneve = uint16(m.TunnelPort)
+		}
 	}
+	return
 }
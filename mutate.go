@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mitchellh/go-homedir"
+)
+
+// payload 变异策略
+const (
+	mutateRandomFill = "random_fill" // 使用随机字节填充
+	mutateZeroFill   = "zero_fill"   // 使用 0 填充
+	mutateBitFlip    = "bit_flip"    // 每个字节以 rate 的概率翻转其中一位
+	mutateInsert     = "insert"      // 在随机位置插入随机字节
+	mutateDelete     = "delete"      // 删除随机位置的连续字节
+	mutateDictionary = "dictionary"  // 将词典中的 token 替换为词典中的另一个 token
+
+	defaultMutateRate = 0.01
+)
+
+var mutateStrategies = []string{mutateRandomFill, mutateZeroFill, mutateBitFlip, mutateInsert, mutateDelete, mutateDictionary}
+
+// loadMutateDictionary 读取词典文件, 每行一个 token, 忽略空行, 按长度降序排列以便优先匹配较长的 token
+func loadMutateDictionary(path string) ([][]byte, error) {
+	path, _ = homedir.Expand(path)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var dictionary [][]byte
+	for _, line := range strings.Split(string(content), "\n") {
+		if token := strings.TrimRight(line, "\r"); token != "" {
+			dictionary = append(dictionary, []byte(token))
+		}
+	}
+	if len(dictionary) < 2 {
+		return nil, errors.New(fmt.Sprintf("dictionary %s must contain at least 2 tokens", path))
+	}
+
+	sort.SliceStable(dictionary, func(i, j int) bool {
+		return len(dictionary[i]) > len(dictionary[j])
+	})
+	return dictionary, nil
+}
+
+// payloadMutation 按照选定的策略修改 payload, 前 keepN 个字节保持不变
+type payloadMutation struct {
+	strategy   string
+	keepN      int
+	rate       float64
+	dictionary [][]byte
+	rand       *rand.Rand
+}
+
+// changesLength 表示该策略是否会改变 payload 的长度, 改变长度时需要修正 TCP 的 seq 和 ack
+func (m *payloadMutation) changesLength() bool {
+	return m.strategy == mutateInsert || m.strategy == mutateDelete || m.strategy == mutateDictionary
+}
+
+// mutate 返回修改后的 payload, 不修改传入的 payload
+func (m *payloadMutation) mutate(payload []byte) []byte {
+	if m.keepN < 0 || len(payload) <= m.keepN {
+		return payload
+	}
+
+	body := append([]byte(nil), payload[m.keepN:]...)
+	switch m.strategy {
+	case mutateRandomFill:
+		m.rand.Read(body)
+	case mutateZeroFill:
+		for i := range body {
+			body[i] = 0
+		}
+	case mutateBitFlip:
+		for i := range body {
+			if m.rand.Float64() < m.rate {
+				body[i] ^= 1 << uint(m.rand.Intn(8))
+			}
+		}
+	case mutateInsert:
+		inserted := make([]byte, m.count(len(body)))
+		m.rand.Read(inserted)
+		pos := m.rand.Intn(len(body) + 1)
+		body = append(body[:pos], append(inserted, body[pos:]...)...)
+	case mutateDelete:
+		// 至少保留一个字节, 避免数据包变为纯 ACK
+		n := m.count(len(body))
+		if n >= len(body) {
+			n = len(body) - 1
+		}
+		pos := m.rand.Intn(len(body) - n + 1)
+		body = append(body[:pos], body[pos+n:]...)
+	case mutateDictionary:
+		body = m.replaceTokens(body)
+	}
+
+	return append(append(make([]byte, 0, m.keepN+len(body)), payload[:m.keepN]...), body...)
+}
+
+// count 返回插入或删除的字节数, 至少为 1
+func (m *payloadMutation) count(length int) int {
+	if n := int(float64(length) * m.rate); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// replaceTokens 将 body 中出现的每个 token 随机替换为词典中的另一个 token
+func (m *payloadMutation) replaceTokens(body []byte) []byte {
+	replaced := make([]byte, 0, len(body))
+	for i := 0; i < len(body); {
+		matched := -1
+		for j, token := range m.dictionary {
+			if bytes.HasPrefix(body[i:], token) {
+				matched = j
+				break
+			}
+		}
+		if matched < 0 {
+			replaced = append(replaced, body[i])
+			i++
+			continue
+		}
+
+		k := m.rand.Intn(len(m.dictionary) - 1)
+		if k >= matched {
+			k++
+		}
+		replaced = append(replaced, m.dictionary[k]...)
+		i += len(m.dictionary[matched])
+	}
+	return replaced
+}
+
+// tcpSeqShift 记录 TCP 单个方向上 payload 长度的变化, 用于修正该方向之后的 seq 以及对端的 ack
+type tcpSeqShift struct {
+	started bool
+	next    uint32 // 期望的下一个 seq (原始序号), 在它之前开始的数据视为重传
+	changes []tcpSeqChange
+	total   uint32 // 所有变化之和
+}
+
+type tcpSeqChange struct {
+	seq   uint32 // 发生变化的 segment 的起始 seq (原始序号)
+	delta uint32 // 按照 uint32 回绕表示的长度变化
+}
+
+// retransmitted 判断从 seq 开始的数据是否已经出现过
+func (s *tcpSeqShift) retransmitted(seq uint32) bool {
+	return s.started && int32(seq-s.next) < 0
+}
+
+// offset 返回原始序号 seq 需要平移的量, 即在 seq 之前开始的 segment 的长度变化之和
+func (s *tcpSeqShift) offset(seq uint32) uint32 {
+	if len(s.changes) == 0 {
+		return 0
+	}
+	if int32(seq-s.changes[len(s.changes)-1].seq) > 0 {
+		return s.total
+	}
+
+	var offset uint32
+	for _, c := range s.changes {
+		if int32(seq-c.seq) > 0 {
+			offset += c.delta
+		}
+	}
+	return offset
+}
+
+// record 记录一个 segment, length 为其在原始序号中占用的长度
+func (s *tcpSeqShift) record(seq uint32, length int, delta int) {
+	if end := seq + uint32(length); !s.started || int32(end-s.next) > 0 {
+		s.started = true
+		s.next = end
+	}
+	if delta != 0 {
+		s.changes = append(s.changes, tcpSeqChange{seq: seq, delta: uint32(delta)})
+		s.total += uint32(delta)
+	}
+}
+
+type tcpFlowKey struct {
+	network, transport gopacket.Flow
+}
+
+// findTCP 返回 packet 中第一个 TCP 层及其之前最近的 IP 层, 不存在时返回 nil
+func findTCP(packet gopacket.Packet) (gopacket.NetworkLayer, *layers.TCP) {
+	var network gopacket.NetworkLayer
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.IPv4:
+			network = l
+		case *layers.IPv6:
+			network = l
+		case *layers.TCP:
+			if network != nil {
+				return network, l
+			}
+		}
+	}
+	return nil, nil
+}
+
+// isFragment 判断 packet 是否为 IP 分片, 分片中的 payload 不完整, 无法修正传输层的校验和
+func isFragment(packet gopacket.Packet) bool {
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.IPv4:
+			if l.Flags&layers.IPv4MoreFragments != 0 || l.FragOffset != 0 {
+				return true
+			}
+		case *layers.IPv6Fragment:
+			return true
+		}
+	}
+	return false
+}
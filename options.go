@@ -101,16 +101,22 @@ PowerShell:
 func init() {
 
 	rootCmd.AddCommand(completionCmd)
+	rootCmd.AddCommand(indexCmd)
 
 	rootCmd.Flags().StringP("config-file", "f", defaultConfigFile, "配置文件路径")
 	// default control params
 	rootCmd.Flags().IntP("concurrency-jobs", "C", 1, "并发 job 数量")
 	rootCmd.Flags().IntP("concurrency-commands", "c", 6, "并发 command 数量")
 	rootCmd.Flags().IntP("test-times", "T", 1, "测试轮数")
+	rootCmd.Flags().Int64("seed", 0, "随机种子, 0 表示随机生成; 种子相同时, 同一 (round, job, command, pcap) 总是生成相同的 pcap, "+
+		"但 adjust-time 以生成时的当前时间为准, 需要完全相同的输出时请关闭 adjust-time")
+	rootCmd.Flags().Int64("variant-seed", 0, "非 0 时直接作为每个 pcap 的种子, 不再与 (round, job, command, pcap) 混合, "+
+		"配合 -O 和只查找到一个 pcap 的 finder, 使用日志或 PcapContext 中的 Seed 重新生成同一个 variant")
 	rootCmd.Flags().Bool("debug", false, "debug mode")
 	rootCmd.Flags().DurationP("duration", "D", 0, "最大运行时长, 0 表示不限制, 可以使用诸如 1h3m5s 的表达式")
 	rootCmd.Flags().DurationP("command-timeout", "S", 30*time.Second, "默认的单个命令执行时长")
 	rootCmd.Flags().StringP("temporary-directory", "w", "/data/.prsdata/history/", "默认的临时文件夹")
+	rootCmd.Flags().String("index-file", defaultIndexFile, "pcap 元数据索引文件路径, 为空表示不使用索引")
 	rootCmd.Flags().BoolP("just-show-jobs", "J", false, "仅打印加载的 job 列表")
 	rootCmd.Flags().BoolP("just-show-pcaps", "j", false, "仅打印加载的 pcap 列表")
 	rootCmd.Flags().Bool("show-command", false, "打印正在执行的命令")
@@ -121,7 +127,11 @@ func init() {
 	rootCmd.Flags().Bool("daemon", false, "作为 daemon 在后台运行")
 	rootCmd.Flags().String("pingback", "", "daemon 模式自动指定, 请勿手动指定")
 	rootCmd.Flags().String("fast-copy", "", "快捷任务, 将查找到的 pcap 修改后拷贝到给定的目录下")
-	rootCmd.Flags().String("fast-merge", "", "快捷任务, 将查找到的 pcap 修改后合并保存为指定路径的 pcap")
+	rootCmd.Flags().String("fast-merge", "", "快捷任务, 将查找到的 pcap 修改后合并保存为指定路径的 pcap, 以 .pcapng 结尾时保存为 pcapng")
+	rootCmd.Flags().String("merge-mode", mergeInterleave, "fast-merge 的合并方式: interleave (按照时间戳交错) 或 concat (依次拼接)")
+	rootCmd.Flags().Duration("merge-offset", 0, "fast-merge 时, interleave 下每个 pcap 依次后移的时间, concat 下相邻 pcap 的间隔")
+	rootCmd.Flags().Int("amplify", 1, "fast-merge 时, 每个 pcap 生成的 variant 数量, 第 k 个 variant 的客户端为其前缀内之后的第 k 个可用地址")
+	rootCmd.Flags().Duration("amplify-spread", 0, "fast-merge 时, 每个 pcap 的 variant 均匀错开在该时长内, 比如 1h")
 	rootCmd.Flags().StringToString("vars", map[string]string{}, "设定自定义变量的值用于命令渲染, 比如 --vars a=b, 可多次使用")
 	rootCmd.Flags().Uint16("profile", 0, "pprof http server port, 0 means disable")
 	rootCmd.Flags().BoolP("quiet", "q", false, "keep quiet")
@@ -129,6 +139,19 @@ func init() {
 	// default modifier params
 	rootCmd.Flags().BoolP("adjust-time", "a", true, "adjust time or not")
 	rootCmd.Flags().DurationP("time-offset", "t", 0, "time offset")
+	rootCmd.Flags().Float64("time-scale", 0, "将 packet 之间的时间间隔乘以该倍数, 比如 0.1 表示快 10 倍, 0 表示不缩放")
+	rootCmd.Flags().Float64("target-pps", 0, "按照指定的 packets/s 匀速重新计算时间戳, 不能与 time-scale / target-bps 同时使用")
+	rootCmd.Flags().Float64("target-bps", 0, "按照指定的 bits/s 匀速重新计算时间戳, 不能与 time-scale / target-pps 同时使用")
+	rootCmd.Flags().Int("fragment-mtu", 0, "将超过该 MTU 的 IP packet 分片, 0 表示不分片")
+	rootCmd.Flags().String("fragment-order", fragmentInOrder, "分片的输出顺序: in_order, reverse, random, overlap (每个分片与前一个重叠 8 字节)")
+	rootCmd.Flags().IntSlice("resegment", nil, "将 TCP payload 依次按照这些长度切分为多个 segment, 循环使用")
+	rootCmd.Flags().Int("resegment-overlap", 0, "重新分段时每个 segment 与前一个重叠的字节数, 必须小于所有的分段长度")
+	rootCmd.Flags().Float64("drop-rate", 0, "每个 packet 被丢弃的概率")
+	rootCmd.Flags().Float64("duplicate-rate", 0, "每个 packet 被重复的概率")
+	rootCmd.Flags().Duration("jitter", 0, "为每个 packet 的时间戳增加 [0, jitter] 的随机延迟")
+	rootCmd.Flags().Float64("reorder-rate", 0, "每个 packet 被推迟输出造成乱序的概率")
+	rootCmd.Flags().Int("reorder-distance", defaultReorderDistance, "乱序的 packet 最多推迟到之后的第几个 packet 后输出")
+	rootCmd.Flags().String("reorder-scope", reorderScopeFlow, "乱序的范围: flow 只与同一个流中的 packet 交换顺序, global 与任意 packet 交换顺序")
 	rootCmd.Flags().BoolP("keep-ip", "K", false, "keep ip or not")
 	rootCmd.Flags().Int("c1", 192, "c1")
 	rootCmd.Flags().Int("c2", 168, "c2")
@@ -140,9 +163,38 @@ func init() {
 	rootCmd.Flags().Int("s4", 22, "s4")
 	rootCmd.Flags().BoolP("use-part-3", "3", false, "use part 3 or not")
 	rootCmd.Flags().BoolP("use-part-4", "4", false, "use part 4 or not")
+	rootCmd.Flags().String("client6", "", "IPv6 客户端网段, 比如 2001:db8:1::/48, 网段以外的高位随机生成, 为空时将 IPv4 网段嵌入 p426-prefix 得到")
+	rootCmd.Flags().String("server6", "", "IPv6 服务端网段, 比如 2001:db8:2::/48, 网段以外的高位随机生成, 为空时将 IPv4 网段嵌入 p426-prefix 得到")
+	rootCmd.Flags().StringSlice("ip-map", nil, "IP 映射规则, 比如 --ip-map 10.0.0.0/8=172.20.0.0/16,192.168.1.10=172.20.1.10, 最长前缀优先, 未匹配的地址按照其他选项处理")
+	rootCmd.Flags().Bool("anonymize", false, "使用前缀保留的匿名化 (Crypto-PAn) 代替随机网段改写 IP, 不能与 keep-ip 同时使用")
+	rootCmd.Flags().String("anonymize-key", "", "匿名化的密钥, 64 位十六进制字符串直接作为密钥, 否则取其 SHA-256, 为空时由 seed 生成")
 	rootCmd.Flags().BoolP("p426", "6", false, "将 IPv4 的 pcap 修改为 IPv6")
+	rootCmd.Flags().String("p426-prefix", defaultP426Prefix, "p426 时 IPv4 地址按照 RFC 6052 嵌入该 prefix, 比如 NAT64 的 64:ff9b::/96")
+	rootCmd.Flags().Bool("p624", false, "将 IPv6 的 pcap 修改为 IPv4, 不能与 p426 同时使用")
+	rootCmd.Flags().String("p624-pool", defaultP624Pool, "p624 时 IPv6 地址映射到的 IPv4 地址池, 嵌入了 p426 prefix 的地址直接还原")
+	rootCmd.Flags().StringToString("port-map", map[string]string{}, "端口映射, 比如 --port-map 80=8080,tcp/25=2525, 不指定协议时同时作用于 TCP 和 UDP")
+	rootCmd.Flags().Bool("random-client-port", false, "将客户端端口随机改写为临时端口, 同一个流中保持一致")
+	rootCmd.Flags().Bool("pop-vlan", false, "弹出所有 VLAN 标签")
+	rootCmd.Flags().Bool("pop-mpls", false, "弹出所有 MPLS label")
+	rootCmd.Flags().IntSlice("push-vlan", nil, "压入的 VLAN ID, 外层在前, 0 表示按流随机生成, 指定两个及以上时为 QinQ")
+	rootCmd.Flags().IntSlice("push-mpls", nil, "压入的 MPLS label, 外层在前, 0 表示按流随机生成")
+	rootCmd.Flags().String("tunnel", "", "将每个帧封装到隧道中: gre, vxlan, geneve, ipip")
+	rootCmd.Flags().String("tunnel-src", defaultTunnelSrc, "隧道外层的客户端 IP, 服务端发出的 packet 使用相反的方向")
+	rootCmd.Flags().String("tunnel-dst", defaultTunnelDst, "隧道外层的服务端 IP, 必须与 tunnel-src 同为 IPv4 或 IPv6")
+	rootCmd.Flags().Uint32("tunnel-key", 0, "VXLAN / GENEVE 的 VNI, GRE 的 key, GRE 为 0 时不带 key")
+	rootCmd.Flags().Int("tunnel-port", 0, "VXLAN / GENEVE 的 UDP 目的端口, 0 表示使用标准端口 4789 / 6081")
+	rootCmd.Flags().Bool("decap", false, "先还原输入中的 GRE / VXLAN / GENEVE / IP-in-IP 隧道 packet")
+	rootCmd.Flags().Bool("rewrite-mac", false, "按照 IP 改写 MAC 地址, 同一个 IP 对应同一个 MAC")
+	rootCmd.Flags().String("mac-oui", "", "改写 MAC 地址时使用的 OUI, 比如 00:16:3e, 为空表示生成本地管理的地址")
+	rootCmd.Flags().StringSlice("mac-pool", nil, "改写 MAC 地址时按顺序分配的地址池, 优先于 mac-oui, 逗号分割指定多个")
 	rootCmd.Flags().IntP("shuffle-payload", "s", 0, "保留指定字节数后随机打乱剩余 payload")
 	rootCmd.Flags().StringP("shuffle-packet", "r", "false", "默认将除了前 3 个 和 后 4 个以外的 packet 全部打乱, 可以使用 n:m 进行覆盖")
+	rootCmd.Flags().String("mutate", "", "payload 变异策略: random_fill, zero_fill, bit_flip, insert, delete, dictionary")
+	rootCmd.Flags().Int("mutate-keep", 0, "payload 变异时保留前指定字节数不做修改")
+	rootCmd.Flags().Float64("mutate-rate", defaultMutateRate, "bit_flip 时每个字节翻转一位的概率, insert/delete 时插入/删除的字节数占 payload 的比例")
+	rootCmd.Flags().String("mutate-dictionary", "", "dictionary 策略使用的词典文件, 每行一个 token, 出现的 token 会被替换为另一个 token")
+	rootCmd.Flags().StringSlice("malform", nil, "损坏 packet 首部的类型: ip_header_length, tcp_data_offset, checksum, truncated_options, tcp_flags, all, 逗号分割指定多个")
+	rootCmd.Flags().Float64("malform-rate", defaultMalformRate, "每个 packet 被损坏的概率, 被损坏的 packet 记录在生成的 pcap 旁边的 .malformed.jsonl 文件中")
 	rootCmd.Flags().StringP("tshark-filter", "R", "", "tshark 的 Read filter, modifier 会根据该 filter 生成一个新的 pcap 供后续处理")
 
 	// default finder params
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+// 默认的 prefix 与早期版本保持一致, 即把 IPv4-mapped 地址 (::ffff:a.b.c.d) 的第一个字节改为 0x01
+const defaultP426Prefix = "100::ffff:0:0/96"
+
+// parseIPv6Prefix 解析 RFC 6052 中允许的 prefix, 长度只能是 32/40/48/56/64/96, 且 64-71 位必须为 0
+func parseIPv6Prefix(s string) (*net.IPNet, error) {
+	ip, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		return nil, errors.New(fmt.Sprintf("%s is not an IPv6 prefix", s))
+	}
+	ones, _ := prefix.Mask.Size()
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, errors.New(fmt.Sprintf("prefix length of %s must be one of 32, 40, 48, 56, 64, 96", s))
+	}
+	if prefix.IP[8] != 0 {
+		return nil, errors.New(fmt.Sprintf("bits 64 to 71 of %s must be zero", s))
+	}
+	return prefix, nil
+}
+
+// ipv4To6Translator 按照 RFC 7915 (SIIT) 将 IPv4 packet 转换为 IPv6, 地址按照 RFC 6052 嵌入到 prefix 中
+type ipv4To6Translator struct {
+	prefix    net.IP
+	prefixLen int
+	positions [4]int // IPv4 地址的每个字节在 IPv6 地址中的位置, 跳过第 8 个字节 (u-octet)
+}
+
+func newIPv4To6Translator(prefix *net.IPNet) *ipv4To6Translator {
+	t := &ipv4To6Translator{prefix: prefix.IP.To16()}
+	t.prefixLen, _ = prefix.Mask.Size()
+
+	pos := t.prefixLen / 8
+	for i := range t.positions {
+		if pos == 8 {
+			pos++
+		}
+		t.positions[i] = pos
+		pos++
+	}
+	return t
+}
+
+// embed 将 IPv4 地址嵌入 prefix
+func (t *ipv4To6Translator) embed(ip4 []byte) net.IP {
+	ip6 := make(net.IP, net.IPv6len)
+	copy(ip6, t.prefix[:t.prefixLen/8])
+	for i, pos := range t.positions {
+		ip6[pos] = ip4[i]
+	}
+	return ip6
+}
+
+// extract 从嵌入了 IPv4 地址的 IPv6 地址中还原 IPv4 地址, 不在 prefix 内时返回 false
+func (t *ipv4To6Translator) extract(ip6 []byte) (net.IP, bool) {
+	if !net.IP(ip6).Mask(net.CIDRMask(t.prefixLen, 128)).Equal(t.prefix) {
+		return nil, false
+	}
+	ip4 := make(net.IP, net.IPv4len)
+	for i, pos := range t.positions {
+		ip4[i] = ip6[pos]
+	}
+	return ip4, true
+}
+
+// embedNet 将 IPv4 网段嵌入 prefix, 掩码随之延长
+func (t *ipv4To6Translator) embedNet(n *net.IPNet) *net.IPNet {
+	ones, _ := n.Mask.Size()
+	ones6 := t.prefixLen
+	if ones > 0 {
+		ones6 = t.positions[(ones-1)/8]*8 + (ones-1)%8 + 1
+	}
+	return &net.IPNet{
+		IP:   t.embed(n.IP.To4()).Mask(net.CIDRMask(ones6, 128)),
+		Mask: net.CIDRMask(ones6, 128),
+	}
+}
+
+// translate 转换以太网帧 (支持 802.1Q / QinQ) 中的 IPv4 packet, 二层保持不变
+func (t *ipv4To6Translator) translate(data []byte) ([]byte, error) {
+	offset, etherType, err := ethernetTypeOffset(data)
+	if err != nil {
+		return nil, err
+	}
+	if etherType != layers.EthernetTypeIPv4 {
+		return nil, fmt.Errorf("ether type is %s (not IPv4)", etherType)
+	}
+
+	ip6, err := t.translateIP(data[offset+2:], false)
+	if err != nil {
+		return nil, err
+	}
+	return replaceEthernetPayload(data, offset, layers.EthernetTypeIPv6, ip6), nil
+}
+
+// ethernetTypeOffset 跳过 802.1Q / QinQ 标签, 返回最内层 ether type 字段的位置
+func ethernetTypeOffset(data []byte) (int, layers.EthernetType, error) {
+	offset := 12
+	for {
+		if offset+2 > len(data) {
+			return 0, 0, fmt.Errorf("truncated ethernet frame")
+		}
+		etherType := layers.EthernetType(binary.BigEndian.Uint16(data[offset : offset+2]))
+		if etherType != layers.EthernetTypeDot1Q && etherType != layers.EthernetTypeQinQ {
+			return offset, etherType, nil
+		}
+		offset += 4
+	}
+}
+
+// replaceEthernetPayload 保留二层首部, 替换 ether type 及其后的数据
+func replaceEthernetPayload(data []byte, offset int, etherType layers.EthernetType, payload []byte) []byte {
+	frame := make([]byte, offset+2+len(payload))
+	copy(frame, data[:offset])
+	binary.BigEndian.PutUint16(frame[offset:], uint16(etherType))
+	copy(frame[offset+2:], payload)
+	return frame
+}
+
+// translateIP 将 IPv4 datagram 转换为 IPv6, 保留 TOS (traffic class) 和 TTL (hop limit), 丢弃 IPv4 options
+// 分片转换为 IPv6 fragment 扩展首部, inner 表示 ICMP 差错报文中携带的原始 datagram, 通常是不完整的
+func (t *ipv4To6Translator) translateIP(ip []byte, inner bool) ([]byte, error) {
+	if len(ip) < 20 || ip[0]>>4 != 4 {
+		return nil, fmt.Errorf("not an IPv4 packet")
+	}
+	ihl := int(ip[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(ip[2:4]))
+	if ihl < 20 || ihl > len(ip) || totalLen < ihl {
+		return nil, fmt.Errorf("invalid IPv4 header")
+	}
+
+	// 去掉以太网的填充, 数据被截断时保留已有的部分
+	payload := ip[ihl:]
+	if totalLen <= len(ip) {
+		payload = ip[ihl:totalLen]
+	}
+	payloadLen := totalLen - ihl
+	complete := len(payload) == payloadLen
+
+	flags := binary.BigEndian.Uint16(ip[6:8])
+	moreFragments := flags&0x2000 != 0
+	fragOffset := flags & 0x1fff
+	fragmented := moreFragments || fragOffset != 0
+
+	src6, dst6 := t.embed(ip[12:16]), t.embed(ip[16:20])
+	protocol := layers.IPProtocol(ip[9])
+	body := append([]byte(nil), payload...)
+
+	switch protocol {
+	case layers.IPProtocolICMPv4:
+		if fragmented {
+			return nil, fmt.Errorf("cannot translate fragmented ICMP")
+		}
+		var err error
+		if body, err = t.translateICMP(body, src6, dst6, complete && !inner); err != nil {
+			return nil, err
+		}
+		payloadLen += len(body) - len(payload)
+		protocol = layers.IPProtocolICMPv6
+	case layers.IPProtocolTCP, layers.IPProtocolUDP:
+		pos := 16
+		if protocol == layers.IPProtocolUDP {
+			pos = 6
+		}
+		if fragOffset != 0 || pos+2 > len(body) {
+			break
+		}
+		if protocol == layers.IPProtocolUDP && binary.BigEndian.Uint16(body[pos:]) == 0 {
+			// IPv6 中 UDP 校验和是必须的, 只有在数据完整时才能计算
+			if complete && !fragmented {
+				binary.BigEndian.PutUint16(body[pos:], ipv6Checksum(src6, dst6, protocol, body))
+			}
+			break
+		}
+		// 伪首部中的长度和协议号不变, 只需要修正地址部分
+		oldAddrs := make([]byte, 2*net.IPv6len)
+		copy(oldAddrs, ip[12:20])
+		updateChecksum(body, pos, oldAddrs, append(append([]byte(nil), src6...), dst6...))
+		if protocol == layers.IPProtocolUDP && binary.BigEndian.Uint16(body[pos:]) == 0 {
+			binary.BigEndian.PutUint16(body[pos:], 0xffff)
+		}
+	}
+
+	headerLen := 40
+	if fragmented {
+		headerLen += 8
+		payloadLen += 8
+	}
+
+	ip6 := make([]byte, headerLen+len(body))
+	tos := ip[1]
+	ip6[0] = 0x60 | tos>>4
+	ip6[1] = tos << 4
+	binary.BigEndian.PutUint16(ip6[4:6], uint16(payloadLen))
+	ip6[6] = byte(protocol)
+	ip6[7] = ip[8]
+	copy(ip6[8:24], src6)
+	copy(ip6[24:40], dst6)
+
+	if fragmented {
+		ip6[6] = byte(layers.IPProtocolIPv6Fragment)
+		frag := ip6[40:48]
+		frag[0] = byte(protocol)
+		fragField := fragOffset << 3
+		if moreFragments {
+			fragField |= 1
+		}
+		binary.BigEndian.PutUint16(frag[2:4], fragField)
+		binary.BigEndian.PutUint32(frag[4:8], uint32(binary.BigEndian.Uint16(ip[4:6])))
+	}
+
+	copy(ip6[headerLen:], body)
+	return ip6, nil
+}
+
+// translateICMP 将 ICMP 报文转换为 ICMPv6, 差错报文中携带的原始 datagram 一并转换
+// 没有对应 ICMPv6 类型的报文返回错误, 数据不完整时只能对 echo 报文增量修正校验和
+func (t *ipv4To6Translator) translateICMP(icmp []byte, src6, dst6 net.IP, complete bool) ([]byte, error) {
+	if len(icmp) < 8 {
+		return nil, fmt.Errorf("truncated ICMP message")
+	}
+
+	oldTypeCode := append([]byte(nil), icmp[0:2]...)
+	icmpType, icmpCode := icmp[0], icmp[1]
+	isError := false
+
+	switch icmpType {
+	case layers.ICMPv4TypeEchoRequest:
+		icmp[0], icmp[1] = layers.ICMPv6TypeEchoRequest, 0
+	case layers.ICMPv4TypeEchoReply:
+		icmp[0], icmp[1] = layers.ICMPv6TypeEchoReply, 0
+	case layers.ICMPv4TypeDestinationUnreachable:
+		isError = true
+		var rest uint32
+		switch icmpCode {
+		case layers.ICMPv4CodeNet, layers.ICMPv4CodeHost, layers.ICMPv4CodeSourceRoutingFailed,
+			layers.ICMPv4CodeNetUnknown, layers.ICMPv4CodeHostUnknown, layers.ICMPv4CodeSourceIsolated,
+			layers.ICMPv4CodeNetTOS, layers.ICMPv4CodeHostTOS:
+			icmp[0], icmp[1] = layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeNoRouteToDst
+		case layers.ICMPv4CodeNetAdminProhibited, layers.ICMPv4CodeHostAdminProhibited,
+			layers.ICMPv4CodeCommAdminProhibited, layers.ICMPv4CodePrecedenceCutoff:
+			icmp[0], icmp[1] = layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeAdminProhibited
+		case layers.ICMPv4CodePort:
+			icmp[0], icmp[1] = layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodePortUnreachable
+		case layers.ICMPv4CodeProtocol:
+			// 指向 IPv6 首部中的 next header 字段
+			icmp[0], icmp[1] = layers.ICMPv6TypeParameterProblem, layers.ICMPv6CodeUnrecognizedNextHeader
+			rest = 6
+		case layers.ICMPv4CodeFragmentationNeeded:
+			// IPv6 首部比 IPv4 多 20 字节
+			icmp[0], icmp[1] = layers.ICMPv6TypePacketTooBig, 0
+			rest = uint32(binary.BigEndian.Uint16(icmp[6:8])) + 20
+		default:
+			return nil, fmt.Errorf("ICMP destination unreachable code %d has no ICMPv6 equivalent", icmpCode)
+		}
+		binary.BigEndian.PutUint32(icmp[4:8], rest)
+	case layers.ICMPv4TypeTimeExceeded:
+		isError = true
+		icmp[0] = layers.ICMPv6TypeTimeExceeded
+		binary.BigEndian.PutUint32(icmp[4:8], 0)
+	default:
+		return nil, fmt.Errorf("ICMP type %d has no ICMPv6 equivalent", icmpType)
+	}
+
+	if isError {
+		inner, err := t.translateIP(icmp[8:], true)
+		if err != nil {
+			return nil, fmt.Errorf("cannot translate ICMP inner packet: %w", err)
+		}
+		icmp = append(icmp[:8], inner...)
+	}
+
+	if complete {
+		binary.BigEndian.PutUint16(icmp[2:4], 0)
+		binary.BigEndian.PutUint16(icmp[2:4], ipv6Checksum(src6, dst6, layers.IPProtocolICMPv6, icmp))
+	} else if !isError {
+		// echo 报文长度不变, 增量加入类型变化和 ICMPv6 的伪首部
+		updateChecksum(icmp, 2, oldTypeCode, icmp[0:2])
+		updateChecksum(icmp, 2, make([]byte, 2*net.IPv6len), append(append([]byte(nil), src6...), dst6...))
+		pseudo := make([]byte, 8)
+		binary.BigEndian.PutUint32(pseudo[0:4], uint32(len(icmp)))
+		pseudo[7] = byte(layers.IPProtocolICMPv6)
+		updateChecksum(icmp, 2, make([]byte, 8), pseudo)
+	}
+	return icmp, nil
+}
+
+// ipv6Checksum 计算包含 IPv6 伪首部的 L4 校验和, 传入 IPv4 地址时与 IPv4 伪首部的结果相同
+func ipv6Checksum(src, dst net.IP, protocol layers.IPProtocol, data []byte) uint16 {
+	sum := onesComplementSum(0, src)
+	sum = onesComplementSum(sum, dst)
+	sum += uint32(len(data)>>16) + uint32(len(data)&0xffff) + uint32(protocol)
+	return foldChecksum(onesComplementSum(sum, data))
+}
+
+// onesComplementSum 按 16 位累加 b, 奇数长度时末尾补 0
+func onesComplementSum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return sum
+}
+
+// foldChecksum 由累加和得到校验和, 结果为 0 时使用等价的 0xffff, 以免 UDP 被视为未计算校验和
+func foldChecksum(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	if checksum := ^uint16(sum); checksum != 0 {
+		return checksum
+	}
+	return 0xffff
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+// 默认使用 RFC 2544 的 benchmark 网段, 不会与真实地址冲突
+const defaultP624Pool = "198.18.0.0/15"
+
+// parseIPv4Pool 解析 IPv4 地址池, 至少需要包含 2 个可用地址
+func parseIPv4Pool(s string) (*net.IPNet, error) {
+	ip, pool, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil {
+		return nil, errors.New(fmt.Sprintf("%s is not an IPv4 network", s))
+	}
+	if ones, _ := pool.Mask.Size(); ones > 30 {
+		return nil, errors.New(fmt.Sprintf("%s is too small, mask must be less than or equal to 30", s))
+	}
+	pool.IP = pool.IP.To4()
+	return pool, nil
+}
+
+// ipv6To4Translator 按照 RFC 7915 (SIIT) 将 IPv6 packet 转换为 IPv4
+// 嵌入了 p426 prefix 的地址直接还原为原 IPv4 地址, 其余地址按照首次出现的顺序依次从地址池中分配, 同一地址总是映射为同一个 IPv4 地址
+type ipv6To4Translator struct {
+	embedded *ipv4To6Translator
+	pool     *net.IPNet
+	next     uint32 // 下一个待分配地址在地址池中的序号
+	mapping  map[string]net.IP
+}
+
+func newIPv6To4Translator(prefix *net.IPNet, pool *net.IPNet) *ipv6To4Translator {
+	return &ipv6To4Translator{
+		embedded: newIPv4To6Translator(prefix),
+		pool:     pool,
+		next:     1, // 跳过网络地址
+		mapping:  make(map[string]net.IP),
+	}
+}
+
+// mapAddress 返回 IPv6 地址对应的 IPv4 地址, 地址池耗尽时返回错误
+func (t *ipv6To4Translator) mapAddress(ip6 []byte) (net.IP, error) {
+	if ip4, ok := t.embedded.extract(ip6); ok {
+		return ip4, nil
+	}
+	if ip4, ok := t.mapping[string(ip6)]; ok {
+		return ip4, nil
+	}
+
+	ones, bits := t.pool.Mask.Size()
+	if size := uint32(1) << uint(bits-ones); t.next >= size-1 { // 跳过广播地址
+		return nil, fmt.Errorf("ipv4 pool %s exhausted", t.pool)
+	}
+	ip4 := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip4, binary.BigEndian.Uint32(t.pool.IP)+t.next)
+	t.next++
+	t.mapping[string(ip6)] = ip4
+	return ip4, nil
+}
+
+// translate 转换以太网帧 (支持 802.1Q / QinQ) 中的 IPv6 packet, 二层保持不变
+func (t *ipv6To4Translator) translate(data []byte) ([]byte, error) {
+	offset, etherType, err := ethernetTypeOffset(data)
+	if err != nil {
+		return nil, err
+	}
+	if etherType != layers.EthernetTypeIPv6 {
+		return nil, fmt.Errorf("ether type is %s (not IPv6)", etherType)
+	}
+
+	ip4, err := t.translateIP(data[offset+2:], false)
+	if err != nil {
+		return nil, err
+	}
+	return replaceEthernetPayload(data, offset, layers.EthernetTypeIPv4, ip4), nil
+}
+
+// translateIP 将 IPv6 datagram 转换为 IPv4, 保留 traffic class (TOS) 和 hop limit (TTL)
+// hop-by-hop / routing / destination options 扩展首部被丢弃, fragment 扩展首部转换为 IPv4 的分片字段,
+// inner 表示 ICMPv6 差错报文中携带的原始 datagram, 通常是不完整的
+func (t *ipv6To4Translator) translateIP(ip []byte, inner bool) ([]byte, error) {
+	if len(ip) < 40 || ip[0]>>4 != 6 {
+		return nil, fmt.Errorf("not an IPv6 packet")
+	}
+
+	payloadLen := int(binary.BigEndian.Uint16(ip[4:6]))
+	if payloadLen == 0 {
+		return nil, fmt.Errorf("cannot translate jumbogram")
+	}
+	end := 40 + payloadLen
+	if end > len(ip) {
+		end = len(ip)
+	}
+
+	// 跳过扩展首部, 记录分片信息
+	protocol := layers.IPProtocol(ip[6])
+	pos := 40
+	fragmented, moreFragments := false, false
+	var fragOffset uint16
+	var identification uint32
+EXTENSIONS:
+	for {
+		switch protocol {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			if pos+8 > end {
+				return nil, fmt.Errorf("truncated IPv6 extension header")
+			}
+			protocol = layers.IPProtocol(ip[pos])
+			pos += (int(ip[pos+1]) + 1) * 8
+		case layers.IPProtocolIPv6Fragment:
+			if pos+8 > end {
+				return nil, fmt.Errorf("truncated IPv6 fragment header")
+			}
+			fragmented = true
+			protocol = layers.IPProtocol(ip[pos])
+			fragField := binary.BigEndian.Uint16(ip[pos+2 : pos+4])
+			fragOffset = fragField >> 3
+			moreFragments = fragField&1 != 0
+			identification = binary.BigEndian.Uint32(ip[pos+4 : pos+8])
+			pos += 8
+		default:
+			break EXTENSIONS
+		}
+	}
+	if pos > end {
+		return nil, fmt.Errorf("truncated IPv6 extension header")
+	}
+
+	payload := ip[pos:end]
+	upperLen := 40 + payloadLen - pos
+	complete := len(payload) == upperLen
+
+	body := append([]byte(nil), payload...)
+
+	// ICMP 没有伪首部, 可以先于地址映射转换, 无法转换的报文 (如邻居发现) 不会占用地址池
+	var err error
+	if protocol == layers.IPProtocolICMPv6 {
+		if fragmented {
+			return nil, fmt.Errorf("cannot translate fragmented ICMPv6")
+		}
+		if body, err = t.translateICMPv6(body, ip[8:24], ip[24:40], upperLen, complete && !inner); err != nil {
+			return nil, err
+		}
+		upperLen += len(body) - len(payload)
+		protocol = layers.IPProtocolICMPv4
+	}
+
+	src4, err := t.mapAddress(ip[8:24])
+	if err != nil {
+		return nil, err
+	}
+	dst4, err := t.mapAddress(ip[24:40])
+	if err != nil {
+		return nil, err
+	}
+
+	switch protocol {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP:
+		csum := 16
+		if protocol == layers.IPProtocolUDP {
+			csum = 6
+		}
+		if fragOffset != 0 || csum+2 > len(body) {
+			break
+		}
+		// 伪首部中的长度和协议号不变, 只需要修正地址部分
+		newAddrs := make([]byte, 2*net.IPv6len)
+		copy(newAddrs, src4)
+		copy(newAddrs[net.IPv4len:], dst4)
+		updateChecksum(body, csum, ip[8:40], newAddrs)
+		if protocol == layers.IPProtocolUDP && binary.BigEndian.Uint16(body[csum:]) == 0 {
+			binary.BigEndian.PutUint16(body[csum:], 0xffff)
+		}
+	}
+
+	ip4 := make([]byte, 20+len(body))
+	ip4[0] = 0x45
+	ip4[1] = ip[0]<<4 | ip[1]>>4
+	binary.BigEndian.PutUint16(ip4[2:4], uint16(20+upperLen))
+	if fragmented {
+		binary.BigEndian.PutUint16(ip4[4:6], uint16(identification))
+		flags := fragOffset
+		if moreFragments {
+			flags |= 0x2000
+		}
+		binary.BigEndian.PutUint16(ip4[6:8], flags)
+	} else {
+		binary.BigEndian.PutUint16(ip4[6:8], 0x4000) // DF
+	}
+	ip4[8] = ip[7]
+	ip4[9] = byte(protocol)
+	copy(ip4[12:16], src4)
+	copy(ip4[16:20], dst4)
+	binary.BigEndian.PutUint16(ip4[10:12], foldChecksum(onesComplementSum(0, ip4[:20])))
+
+	copy(ip4[20:], body)
+	return ip4, nil
+}
+
+// translateICMPv6 将 ICMPv6 报文转换为 ICMP, 差错报文中携带的原始 datagram 一并转换
+// 没有对应 ICMP 类型的报文 (如邻居发现) 返回错误, 数据不完整时只能对 echo 报文增量修正校验和
+func (t *ipv6To4Translator) translateICMPv6(icmp []byte, src6, dst6 []byte, length int, complete bool) ([]byte, error) {
+	if len(icmp) < 8 {
+		return nil, fmt.Errorf("truncated ICMPv6 message")
+	}
+
+	oldTypeCode := append([]byte(nil), icmp[0:2]...)
+	icmpType, icmpCode := icmp[0], icmp[1]
+	isError := false
+
+	switch icmpType {
+	case layers.ICMPv6TypeEchoRequest:
+		icmp[0], icmp[1] = layers.ICMPv4TypeEchoRequest, 0
+	case layers.ICMPv6TypeEchoReply:
+		icmp[0], icmp[1] = layers.ICMPv4TypeEchoReply, 0
+	case layers.ICMPv6TypeDestinationUnreachable:
+		isError = true
+		icmp[0] = layers.ICMPv4TypeDestinationUnreachable
+		switch icmpCode {
+		case layers.ICMPv6CodeNoRouteToDst, layers.ICMPv6CodeBeyondScopeOfSrc, layers.ICMPv6CodeAddressUnreachable:
+			icmp[1] = layers.ICMPv4CodeHost
+		case layers.ICMPv6CodeAdminProhibited:
+			icmp[1] = layers.ICMPv4CodeHostAdminProhibited
+		case layers.ICMPv6CodePortUnreachable:
+			icmp[1] = layers.ICMPv4CodePort
+		default:
+			return nil, fmt.Errorf("ICMPv6 destination unreachable code %d has no ICMP equivalent", icmpCode)
+		}
+		binary.BigEndian.PutUint32(icmp[4:8], 0)
+	case layers.ICMPv6TypePacketTooBig:
+		// IPv4 首部比 IPv6 少 20 字节
+		isError = true
+		icmp[0], icmp[1] = layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded
+		mtu := binary.BigEndian.Uint32(icmp[4:8]) - 20
+		if mtu > 0xffff {
+			mtu = 0xffff
+		}
+		binary.BigEndian.PutUint32(icmp[4:8], mtu)
+	case layers.ICMPv6TypeTimeExceeded:
+		isError = true
+		icmp[0] = layers.ICMPv4TypeTimeExceeded
+		binary.BigEndian.PutUint32(icmp[4:8], 0)
+	case layers.ICMPv6TypeParameterProblem:
+		if icmpCode != layers.ICMPv6CodeUnrecognizedNextHeader {
+			return nil, fmt.Errorf("ICMPv6 parameter problem code %d has no ICMP equivalent", icmpCode)
+		}
+		isError = true
+		icmp[0], icmp[1] = layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeProtocol
+		binary.BigEndian.PutUint32(icmp[4:8], 0)
+	default:
+		return nil, fmt.Errorf("ICMPv6 type %d has no ICMP equivalent", icmpType)
+	}
+
+	if isError {
+		inner, err := t.translateIP(icmp[8:], true)
+		if err != nil {
+			return nil, fmt.Errorf("cannot translate ICMPv6 inner packet: %w", err)
+		}
+		icmp = append(icmp[:8], inner...)
+	}
+
+	if complete {
+		binary.BigEndian.PutUint16(icmp[2:4], 0)
+		binary.BigEndian.PutUint16(icmp[2:4], foldChecksum(onesComplementSum(0, icmp)))
+	} else if !isError {
+		// echo 报文长度不变, 增量去除类型变化和 ICMPv6 的伪首部
+		updateChecksum(icmp, 2, oldTypeCode, icmp[0:2])
+		updateChecksum(icmp, 2, append(append([]byte(nil), src6...), dst6...), make([]byte, 2*net.IPv6len))
+		pseudo := make([]byte, 8)
+		binary.BigEndian.PutUint32(pseudo[0:4], uint32(length))
+		pseudo[7] = byte(layers.IPProtocolICMPv6)
+		updateChecksum(icmp, 2, pseudo, make([]byte, 8))
+	}
+	return icmp, nil
+}
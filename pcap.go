@@ -24,10 +24,18 @@ type Pcap struct {
 	createDirOnce    sync.Once
 	workingDirectory string
 
-	copyFilePath  string // init 阶段拷贝一份到该目录下利用
-	cacheFilePath string // init 阶段生成 cache file
-	info          *PcapInfo
-	hasIPv6       bool
+	copyFilePath string              // 由 prepare 拷贝一份到该目录下利用
+	copyFormat   pcapFormat          // 拷贝文件的实际格式, 转换 link type 后可能与源文件不同, 生成的文件与之保持一致
+	classifier   *endpointClassifier // 由 classify 生成, 代替 tcpprep 的 cache file
+	info         *PcapInfo
+	hasIPv6      bool
+
+	preparation *PcapIndexPreparation // 命中索引时由 finder 填充, 表示上次加载时已经成功完成 prepare
+
+	prepareOnce  sync.Once
+	prepareErr   error
+	classifyOnce sync.Once
+	classifyErr  error
 
 	counter atomic.Int32
 }
@@ -69,13 +77,16 @@ func (p *Pcap) init() error {
 				return
 			}
 
-			// get pcap info
-			info, err1 := parsePcapInfo(p.file.path)
-			if err1 != nil {
-				err = err1
-				return
+			// get pcap info, 命中索引时已经由 finder 提前填充
+			if p.info == nil {
+				info, err1 := parsePcapInfo(p.file.path)
+				if err1 != nil {
+					err = err1
+					return
+				}
+				p.info = info
+				pcapIndex.store(p.file.path, p.file.info, info)
 			}
-			p.info = info
 
 			if p.file.finder.OnlyEthernet && !p.info.IsEthernet() {
 				err = errors.New(fmt.Sprintf("not ethernet encapsulation (%s)", p.info.Encapsulation))
@@ -87,69 +98,71 @@ func (p *Pcap) init() error {
 			if err != nil {
 				return
 			}
-			// copy to working directory
 			p.copyFilePath = filepath.Join(p.workingDirectory, p.file.baseName)
-			if p.info.IsEthernet() {
-				err = p.file.copyTo(p.copyFilePath)
-			} else {
-				ret := pcapTool.convertDLT2Ethernet(p.file.path, p.copyFilePath, 0)
-				err = ret.err
-			}
 
-			if err != nil {
+			adjustTime := p.file.finder.modifier.adjustTime()
+			if adjustTime && (p.info.error&PCAP_INFO_ERR_LAST_PACKET_TIME) != 0 {
+				err = errors.New(fmt.Sprintf("errors when parse last packet time: %s", p.info.LastPacketTime))
 				return
 			}
 
-			if p.file.finder.modifier.AdjustTime {
-				if (p.info.error & PCAP_INFO_ERR_LAST_PACKET_TIME) != 0 {
-					err = errors.New(fmt.Sprintf("errors when parse last packet time: %s", p.info.LastPacketTime))
-					return
-				}
-				dst := filepath.Join(p.workingDirectory, fmt.Sprintf("%s.adjust-time", p.file.name))
-				result := pcapTool.adjustTime(p.copyFilePath, dst, p.timeOffset())
-				adjf := File{path: dst}
-				defer adjf.delete()
-				if !result.succeed {
-					err = result.err
+			// 命中索引且上次加载时已经完成了同样的检查, 拷贝和分类推迟到第一次生成 variant 时执行
+			deferred := p.preparation != nil && (p.preparation.AdjustTime || !adjustTime)
+			if deferred {
+				p.copyFormat = pcapFormat{pcapNg: p.preparation.PcapNg, nanosecond: p.preparation.Nanosecond}
+			} else {
+				if err = p.prepare(); err != nil {
 					return
 				}
+				pcapIndex.storePreparation(p.file.path, &PcapIndexPreparation{
+					PcapNg:     p.copyFormat.pcapNg,
+					Nanosecond: p.copyFormat.nanosecond,
+					AdjustTime: adjustTime,
+				})
 			}
 
-			if p.file.finder.TsharkReadFilter != "" {
-				pcapType := "pcap"
-				if p.info.IsPcapNG() {
-					pcapType = "pcapng"
+			if filter := p.file.finder.TsharkReadFilter; filter != "" {
+				// 过滤结果记录在索引中, 文件未变化时不再重复执行 tshark
+				packets, ok := pcapIndex.filteredPackets(p.file.path, filter)
+				if !ok {
+					if err = p.prepare(); err != nil {
+						return
+					}
+					pcapType := "pcap"
+					if p.copyFormat.pcapNg {
+						pcapType = "pcapng"
+					}
+					rfFile := filepath.Join(p.workingDirectory, fmt.Sprintf("%s.tshark_rf", p.file.name))
+					result := pcapTool.tsharkReadFilter(p.copyFilePath, rfFile, filter, pcapType, 0)
+					if !result.succeed {
+						err = result.err
+						return
+					}
+					info2, err2 := parsePcapInfo(rfFile)
+					rff := File{path: rfFile}
+					defer rff.delete()
+					if err2 != nil {
+						err = err2
+						return
+					}
+					packets = info2.packetCount
+					pcapIndex.storeFilteredPackets(p.file.path, filter, packets)
 				}
-				rfFile := filepath.Join(p.workingDirectory, fmt.Sprintf("%s.tshark_rf", p.file.name))
-				result := pcapTool.tsharkReadFilter(p.copyFilePath, rfFile, p.file.finder.TsharkReadFilter, pcapType, 0)
-				if !result.succeed {
-					err = result.err
-					return
-				}
-				info2, err2 := parsePcapInfo(rfFile)
-				rff := File{path: rfFile}
-				defer rff.delete()
-				if err2 != nil {
-					err = err2
-					return
-				}
-				if info2.packetCount <= 0 {
+				if packets <= 0 {
 					err = errors.New("no packets left after tshark filter")
 					return
 				}
 			}
 
-			if !p.file.finder.modifier.KeepIp {
-				// first, generate cache file
-				p.cacheFilePath = filepath.Join(p.workingDirectory, fmt.Sprintf("%s.cache", p.file.name))
-				result := pcapTool.generateCache(p.copyFilePath, p.cacheFilePath, 0)
-				if !result.succeed {
-					err = result.err
+			if p.info.ipv6Checked {
+				p.hasIPv6 = p.info.hasIPv6
+			} else if !p.file.finder.modifier.keepIP() {
+				// 通过 capinfos 获取的信息中不包含 IPv6 标记, 需要单独检测, 结果记录在索引中
+				if err = p.prepare(); err != nil {
 					return
 				}
-
 				ipv6File := filepath.Join(p.workingDirectory, fmt.Sprintf("%s.ipv6", p.file.name))
-				result = pcapTool.filterIPv6(p.copyFilePath, ipv6File, 0)
+				result := pcapTool.filterIPv6(p.copyFilePath, ipv6File, 0)
 				if !result.succeed {
 					err = result.err
 					return
@@ -162,16 +175,12 @@ func (p *Pcap) init() error {
 					return
 				}
 				p.hasIPv6 = info2.packetCount > 0
+				p.info.hasIPv6, p.info.ipv6Checked = p.hasIPv6, true
+				pcapIndex.storeIPv6(p.file.path, p.hasIPv6)
+			}
 
-				endpoints := p.file.finder.modifier.randomEndPoints(p.hasIPv6)
-				modifyIPFile := filepath.Join(p.workingDirectory, fmt.Sprintf("%s.modify-ip", p.file.name))
-				result = pcapTool.modifyIp(p.copyFilePath, modifyIPFile, p.cacheFilePath, endpoints, 0)
-				modifyf := File{path: modifyIPFile}
-				defer modifyf.delete()
-				if !result.succeed {
-					err = errors.New(fmt.Sprintf("can not modify ip: %s", result.err))
-					return
-				}
+			if !deferred && !p.file.finder.modifier.keepIP() {
+				err = p.classify()
 			}
 		})
 	} else if !p.initSucceed {
@@ -180,107 +189,299 @@ func (p *Pcap) init() error {
 	return err
 }
 
-func (p *Pcap) timeOffset() int64 {
-	adjustment := time.Now().Sub(p.info.lastPacketTime) - p.file.finder.modifier.TimeOffset
-	return int64(adjustment) / int64(time.Second)
+// prepare 将源文件拷贝 (或转换为以太网) 到工作目录, 并检查能否平移时间, 仅执行一次
+// 没有命中索引时在 init 中执行, 提前发现无法处理的 pcap; 命中索引时推迟到第一次生成 variant 时执行
+func (p *Pcap) prepare() error {
+	p.prepareOnce.Do(func() {
+		p.prepareErr = p.copyToWorkingDirectory()
+		if p.prepareErr == nil && p.file.finder.modifier.adjustTime() {
+			if err := p.checkAdjustTime(); err != nil {
+				p.prepareErr = errors.New(fmt.Sprintf("can not adjust time: %s", err))
+			}
+		}
+	})
+	return p.prepareErr
 }
 
-func (p *Pcap) new() (string, error) {
-	// 先拷贝一份源文件
-	nid := p.counter.Inc()
+// copyToWorkingDirectory 拷贝源文件, 非以太网的 link type 通过 tcprewrite 转换, 并读取拷贝文件的格式
+func (p *Pcap) copyToWorkingDirectory() error {
+	var err error
+	if p.info.IsEthernet() {
+		err = p.file.copyTo(p.copyFilePath)
+	} else if pcapTool.Tcprewrite == "" || pcapTool.Tcpprep == "" {
+		err = errors.New(fmt.Sprintf("tcprewrite and tcpprep are required to convert %s to ethernet", p.info.Encapsulation))
+	} else {
+		ret := pcapTool.convertDLT2Ethernet(p.file.path, p.copyFilePath, 0)
+		err = ret.err
+	}
+	if err != nil {
+		return err
+	}
 
-	srcBase := filepath.Join(p.workingDirectory, fmt.Sprintf("%s_%06d", p.file.name, nid))
-	var ext = ".pcap"
-	src := fmt.Sprintf("%s%s", srcBase, ext)
+	p.copyFormat, err = readPcapFileFormat(p.copyFilePath)
+	return err
+}
 
-	if p.info.IsPcapNG() {
-		result := pcapTool.pcapng2pcap(p.copyFilePath, src)
-		if !result.succeed {
-			return "", result.err
+// checkAdjustTime 与 new 使用同样的步骤平移一次时间, 在加载时提前发现无法处理的 pcap, 平移后的文件不保留
+func (p *Pcap) checkAdjustTime() error {
+	pipeline := &packetPipeline{}
+	for _, step := range p.file.finder.modifier.pipelineSteps(false) {
+		if step.Name == stepAdjustTime {
+			p.appendStage(pipeline, step.Name, step.modifier, pcapVariant{}, "")
 		}
-	} else {
-		err := copyTo(p.copyFilePath, src)
-		if err != nil {
-			return "", err
+	}
+	dst := filepath.Join(p.workingDirectory, fmt.Sprintf("%s.adjust-time%s", p.file.name, filepath.Ext(p.copyFilePath)))
+	defer deleteFile(dst)
+	return pipeline.run(p.copyFilePath, dst)
+}
+
+// classify 判断拷贝文件中的 IP 是客户端还是服务端, 仅执行一次
+// 保留 IP 时只有放大需要区分客户端, 因此在第一次放大时才执行; 命中索引时在第一次生成 variant 时执行
+func (p *Pcap) classify() error {
+	p.classifyOnce.Do(func() {
+		p.classifier, p.classifyErr = classifyPCAP(p.copyFilePath)
+	})
+	return p.classifyErr
+}
+
+// timeOffset 按照 modifier 计算时间的平移量, 使得修改后的最后一个 packet 的时间恰好为 now - TimeOffset
+// retime 步骤以第一个 packet 为起点重新计算时间戳, 按照其结果推算最后一个 packet 的时间:
+// 缩放时间间隔时按比例缩放, 按照 pps / bps 匀速发送时按照原始的 packet 数量和平均长度计算
+// 平移量取决于生成时的当前时间, 因此即使种子相同, 开启 adjust_time 时两次生成的 pcap 时间戳也不同
+func (p *Pcap) timeOffset(modifier *Modifier) time.Duration {
+	first, last := p.info.firstPacketTime, p.info.lastPacketTime
+	for _, retime := range p.file.finder.modifier.retimeModifiers() {
+		last = p.retimedLast(retime, first, last)
+	}
+	return time.Now().Sub(last) - modifier.TimeOffset
+}
+
+// retimedLast 返回经过 retime 后最后一个 packet 的时间, 无法推算时保持不变
+func (p *Pcap) retimedLast(retime *Modifier, first, last time.Time) time.Time {
+	count := p.info.packetCount
+	switch {
+	case retime.TimeScale > 0:
+		return first.Add(time.Duration(float64(last.Sub(first)) * retime.TimeScale))
+	case retime.TargetPps > 0 && count > 0:
+		return first.Add(time.Duration(float64(count-1) / retime.TargetPps * float64(time.Second)))
+	case retime.TargetBps > 0 && count > 0 && p.info.avgPacketSize > 0:
+		// 最后一个 packet 的时间由之前所有 packet 的总位数决定
+		bits := float64(count-1) * p.info.avgPacketSize * 8
+		return first.Add(time.Duration(bits / retime.TargetBps * float64(time.Second)))
+	}
+	return last
+}
+
+// new 生成一个新的 variant, 其中所有的随机修改都由 variant 的种子决定, 同时返回生成的 pcap 的信息
+func (p *Pcap) new(variant pcapVariant) (string, *PcapInfo, error) {
+	if err := p.prepare(); err != nil {
+		return "", nil, errors.New(fmt.Sprintf("prepare failed: %s", err))
+	}
+	if variant.amplifyIndex > 0 || !p.file.finder.modifier.keepIP() {
+		if err := p.classify(); err != nil {
+			return "", nil, errors.New(fmt.Sprintf("classify failed: %s", err))
 		}
 	}
 
-	nfrf := fmt.Sprintf("%s.rf%s", srcBase, ext)
-	nfp426 := fmt.Sprintf("%s.p426%s", srcBase, ext)
-	nft := fmt.Sprintf("%s.adjust-time%s", srcBase, ext)
-	nfm := fmt.Sprintf("%s.modify-ip%s", srcBase, ext)
+	nid := p.counter.Inc()
 
-	if p.file.finder.modifier.TsharkReadFilter != "" {
+	srcBase := filepath.Join(p.workingDirectory, fmt.Sprintf("%s_%06d", p.file.name, nid))
+	var ext = ".pcap"
+	if p.copyFormat.pcapNg {
+		ext = ".pcapng"
+	}
+	dst := fmt.Sprintf("%s%s", srcBase, ext)
+
+	// tshark 无法融合进流水线, 先单独过滤一次
+	src := p.copyFilePath
+	if filter := p.file.finder.modifier.tsharkFilter(); filter != "" {
 		pcapType := "pcap"
-		//if p.info.IsPcapNG() {
-		//	pcapType = "pcapng"
-		//}
-		result := pcapTool.tsharkReadFilter(src, nfrf, p.file.finder.modifier.TsharkReadFilter, pcapType, 0)
-		if !result.succeed {
-			return "", result.err
+		if p.copyFormat.pcapNg {
+			pcapType = "pcapng"
 		}
-		err := os.Rename(nfrf, src)
-		if err != nil {
-			return "", err
+		nfrf := fmt.Sprintf("%s.rf%s", srcBase, filepath.Ext(p.copyFilePath))
+		result := pcapTool.tsharkReadFilter(p.copyFilePath, nfrf, filter, pcapType, 0)
+		rff := File{path: nfrf}
+		defer rff.delete()
+		if !result.succeed {
+			return "", nil, result.err
 		}
+		src = nfrf
 	}
 
-	if p.file.finder.modifier.P426 {
-		err := ConvertPCAP(src, nfp426, false)
-		if err != nil {
-			return "", err
-		}
-		err = os.Rename(nfp426, src)
-		if err != nil {
-			return "", err
-		}
+	pipeline := p.newPipeline(variant, dst)
+	err := pipeline.run(src, dst)
+	if err != nil {
+		deleteFile(dst)
+		deleteFile(malformedRecordPath(dst))
+		return "", nil, err
 	}
 
-	if p.file.finder.modifier.ShufflePayload > 0 || p.file.finder.modifier.shufflePacket {
-		err := shufflePCAP(src, nfp426, false, ShuffleOptions{
-			KeepN:         p.file.finder.modifier.ShufflePayload,
-			RandomPacket:  p.file.finder.modifier.shufflePacket,
-			RandomPacketN: p.file.finder.modifier.shufflePacketN,
-			RandomPacketM: p.file.finder.modifier.shufflePacketM,
-		})
-		if err != nil {
-			return "", err
-		}
-		err = os.Rename(nfp426, src)
-		if err != nil {
-			return "", err
-		}
+	return dst, pipeline.info, nil
+}
+
+// newPipeline 按照 modifier 的 steps 依次组装修改步骤, 未指定 steps 时的顺序为:
+// pop tags -> decap -> P426 / P624 -> shuffle -> mutate payload -> adjust time -> modify port -> modify ip (or anonymize) -> modify mac -> resegment -> fragment -> impair -> malform -> encap -> push tags -> retime
+func (p *Pcap) newPipeline(variant pcapVariant, dst string) *packetPipeline {
+	modifier := p.file.finder.modifier
+	pipeline := &packetPipeline{}
+	// 保留 IP 且不放大时不区分方向, 所有 packet 视为客户端发出
+	if !modifier.keepIP() || variant.amplifyIndex > 0 {
+		pipeline.classifier = p.classifier
 	}
 
-	if p.file.finder.modifier.AdjustTime {
-		result := pcapTool.adjustTime(src, nft, p.timeOffset())
-		if !result.succeed {
-			return "", result.err
-		}
-		err := os.Rename(nft, src)
-		if err != nil {
-			return "", err
-		}
+	for _, step := range modifier.pipelineSteps(variant.amplifyIndex > 0) {
+		p.appendStage(pipeline, step.Name, step.modifier, variant, dst)
 	}
+	return pipeline
+}
+
+// appendStage 使用 modifier 中的配置构建名为 name 的步骤, filter 在流水线之前由 tshark 执行, 这里忽略
+// 客户端/服务端网段使用 pcap 的种子, 放大时所有 variant 相同, 其余随机修改使用 variant 的种子
+func (p *Pcap) appendStage(pipeline *packetPipeline, name string, modifier *Modifier, variant pcapVariant, dst string) {
+	seed := variant.variantSeed()
+	switch name {
+	case stepPopTags:
+		pipeline.stages = append(pipeline.stages, &tagStage{rewriter: &tagRewriter{popVlan: modifier.PopVlan, popMpls: modifier.PopMpls}})
+
+	case stepDecap:
+		vxlan, geneve := modifier.tunnelPorts()
+		pipeline.stages = append(pipeline.stages, &decapStage{decapsulator: &tunnelDecapsulator{vxlanPort: vxlan, genevePort: geneve}})
+
+	case stepP426:
+		pipeline.stages = append(pipeline.stages, &p426Stage{translator: newIPv4To6Translator(modifier.p426Prefix)})
+
+	case stepP624:
+		pipeline.stages = append(pipeline.stages, &p624Stage{translator: newIPv6To4Translator(modifier.p426Prefix, modifier.p624Pool)})
+
+	case stepShufflePacket:
+		pipeline.stages = append(pipeline.stages, &shufflePacketStage{
+			n:    modifier.shufflePacketN,
+			m:    modifier.shufflePacketM,
+			rand: subRand(seed, "shuffle_packet"),
+			dir:  filepath.Dir(dst),
+		})
 
-	if !p.file.finder.modifier.KeepIp {
+	case stepShufflePayload:
+		pipeline.stages = append(pipeline.stages, &shufflePayloadStage{
+			keepN: modifier.ShufflePayload,
+			rand:  subRand(seed, "shuffle_payload"),
+		})
 
-		hasIPv6 := p.hasIPv6 || p.file.finder.modifier.P426
-		endpoints := p.file.finder.modifier.randomEndPoints(hasIPv6)
-		result := pcapTool.modifyIp(src, nfm, p.cacheFilePath, endpoints, 0)
-		if !result.succeed {
-			return "", errors.New(fmt.Sprintf("can not modify ip: %s", result.err))
+	case stepMutate:
+		pipeline.stages = append(pipeline.stages, newMutatePayloadStage(&payloadMutation{
+			strategy:   modifier.Mutate,
+			keepN:      modifier.MutateKeep,
+			rate:       modifier.MutateRate,
+			dictionary: modifier.mutateDictionary,
+			rand:       subRand(seed, "mutate"),
+		}))
+
+	case stepAdjustTime:
+		pipeline.stages = append(pipeline.stages, &adjustTimeStage{offset: p.timeOffset(modifier)})
+		pipeline.nanosecond = true
+
+	case stepPort:
+		pipeline.stages = append(pipeline.stages, &portStage{
+			remapper: newPortRemapper(modifier.portMap, modifier.RandomClientPort, subRand(seed, "port")),
+		})
+
+	case stepIP, stepAnonymize:
+		stage := &ipStage{ipMap: modifier.ipMap}
+		if modifier.Anonymize {
+			stage.anonymizer = newCryptoPAn(modifier.anonymizeKey())
+		} else if !modifier.KeepIp {
+			hasIPv6 := (p.hasIPv6 && !modifier.P624) || modifier.P426
+			stage.endpoints = modifier.randomEndPoints(hasIPv6, subRand(variant.seed, "endpoints"))
+			logger.Debugf("%s rewrite endpoints to %s\n", p, stage.endpoints)
 		}
-		err := os.Rename(nfm, src)
-		if err != nil {
-			return "", err
+		if variant.amplifyIndex > 0 {
+			stage.amplifier = newHostAmplifier(variant, stage.endpoints)
+			for _, server := range p.classifier.servers() {
+				stage.amplifier.addServer(stage.rewrite(server, false))
+			}
 		}
-	}
+		pipeline.stages = append(pipeline.stages, stage)
+
+	case stepMac:
+		pipeline.stages = append(pipeline.stages, &macStage{
+			rewriter: newMacRewriter(modifier.macOui, modifier.macPool, subRand(seed, "mac")),
+		})
+
+	case stepResegment:
+		pipeline.stages = append(pipeline.stages, &resegmentStage{
+			resegmenter: &tcpResegmenter{sizes: modifier.Resegment, overlap: modifier.ResegmentOverlap},
+		})
+
+	case stepFragment:
+		pipeline.stages = append(pipeline.stages, &fragmentStage{
+			fragmenter: &ipFragmenter{mtu: modifier.FragmentMtu, order: modifier.FragmentOrder, rand: subRand(seed, "fragment")},
+		})
+
+	case stepImpair:
+		pipeline.stages = append(pipeline.stages, &impairStage{
+			dropRate:        modifier.DropRate,
+			duplicateRate:   modifier.DuplicateRate,
+			jitter:          modifier.Jitter,
+			reorderRate:     modifier.ReorderRate,
+			reorderDistance: modifier.ReorderDistance,
+			reorderScope:    modifier.ReorderScope,
+			rand:            subRand(seed, "impair"),
+			name:            p.String(),
+		})
 
-	return src, nil
+	case stepMalform:
+		pipeline.stages = append(pipeline.stages, &malformStage{
+			malformer:  &headerMalformer{kinds: modifier.malformKinds, rand: subRand(seed, "malform")},
+			rate:       modifier.MalformRate,
+			recordPath: malformedRecordPath(dst),
+		})
+
+	case stepEncap:
+		port, geneve := modifier.tunnelPorts()
+		if modifier.Tunnel == tunnelGENEVE {
+			port = geneve
+		}
+		pipeline.stages = append(pipeline.stages, &encapStage{encapsulator: &tunnelEncapsulator{
+			kind: modifier.Tunnel,
+			src:  modifier.tunnelSrc,
+			dst:  modifier.tunnelDst,
+			key:  modifier.TunnelKey,
+			port: port,
+			seed: mixSeed(seed, "tunnel"),
+		}})
+
+	case stepPushTags:
+		pipeline.stages = append(pipeline.stages, &tagStage{rewriter: &tagRewriter{
+			pushVlan: modifier.PushVlan,
+			pushMpls: modifier.PushMpls,
+			seed:     mixSeed(seed, "tag"),
+		}})
+
+	case stepRetime:
+		pipeline.stages = append(pipeline.stages, &retimeStage{
+			scale: modifier.TimeScale,
+			pps:   modifier.TargetPps,
+			bps:   modifier.TargetBps,
+		})
+		pipeline.nanosecond = true
+	}
 }
 
+// parsePcapInfo 优先使用内置的解析器, 仅当其失败且 capinfos 可用时才回退到 capinfos
 func parsePcapInfo(src string) (*PcapInfo, error) {
+	info, err := readPcapInfo(src)
+	if err == nil {
+		return info, nil
+	}
+	if pcapTool.Capinfos == "" {
+		return nil, err
+	}
+	logger.Debugf("native parser failed on %s, fallback to capinfos: %s\n", src, err)
+	return parsePcapInfoByCapinfos(src)
+}
+
+func parsePcapInfoByCapinfos(src string) (*PcapInfo, error) {
 	result := pcapTool.getPcapInfo(src, 0)
 	if result.succeed {
 		v := viper.New()
@@ -19,6 +19,10 @@ type PcapContext struct {
 	Ext               string
 	HasIpv6           bool
 	PacketCount       int64
+	PacketRate        float64 // 生成的 pcap 的平均 pps, 无法计算时为 -1
+	BitRate           float64 // 生成的 pcap 的平均 bps, 无法计算时为 -1
+	Seed              int64  // 生成该 pcap 所用的种子, 使用 --variant-seed 指定该值即可重新生成该 pcap
+	MalformedPath     string // 记录被损坏的 packet 的文件, 未开启 malform 时为空
 }
 
 var samplePcapContext = PcapContext{
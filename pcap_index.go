@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+const pcapIndexVersion = 2
+
+// 为 nil 时表示未启用索引, 所有方法均可安全调用
+var pcapIndex *PcapIndex
+
+// PcapIndexEntry 记录单个 pcap 文件的元数据, 文件的大小和修改时间都不变时直接复用
+// SHA1 只在 index prune 时校验, 避免每次启动都读取全部文件
+type PcapIndexEntry struct {
+	Path        string   `json:"path"`
+	Size        int64    `json:"size"`
+	ModTime     int64    `json:"mod_time"` // UnixNano
+	SHA1        string   `json:"sha1"`
+	HasIPv6     bool     `json:"has_ipv6"`
+	IPv6Checked bool     `json:"ipv6_checked"` // HasIPv6 是否有效, 通过 capinfos 获取的信息需要单独检测
+	Info        PcapInfo `json:"info"`
+
+	// finder 的 tshark_read_filter 过滤后剩余的 packet 数量, key 为过滤表达式
+	FilteredPackets map[string]int64 `json:"filtered_packets,omitempty"`
+
+	// 上次加载时准备工作的结果, 命中索引时不再提前拷贝和检查
+	Prepared *PcapIndexPreparation `json:"prepared,omitempty"`
+}
+
+// PcapIndexPreparation 记录 Pcap.init 中拷贝 (转换 link type) 和检查的结果
+type PcapIndexPreparation struct {
+	PcapNg     bool `json:"pcapng"`      // 拷贝文件的格式
+	Nanosecond bool `json:"nanosecond"`  // 拷贝文件的精度
+	AdjustTime bool `json:"adjust_time"` // 是否已经通过 adjust_time 的检查
+}
+
+// PcapIndex 以 pcap 的绝对路径为 key 持久化保存 PcapIndexEntry
+type PcapIndex struct {
+	Version int                        `json:"version"`
+	Entries map[string]*PcapIndexEntry `json:"entries"`
+
+	path  string
+	dirty bool
+	lock  sync.Mutex
+}
+
+func (idx *PcapIndex) String() string {
+	return fmt.Sprintf("[Pcap Index %s]", idx.path)
+}
+
+// loadPcapIndex 从指定路径加载索引, 文件不存在时返回一个空索引
+func loadPcapIndex(path string) (*PcapIndex, error) {
+	idx := &PcapIndex{
+		Version: pcapIndexVersion,
+		Entries: make(map[string]*PcapIndexEntry),
+		path:    path,
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("can not read pcap index %s: %s", path, err))
+	}
+
+	err = json.Unmarshal(content, idx)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("can not unmarshal pcap index %s: %s", path, err))
+	}
+
+	if idx.Version != pcapIndexVersion {
+		logger.Warnln(fmt.Sprintf("%s version %d mismatch, discard it", idx, idx.Version))
+		idx.Version = pcapIndexVersion
+		idx.Entries = make(map[string]*PcapIndexEntry)
+		idx.dirty = true
+	}
+	if idx.Entries == nil {
+		idx.Entries = make(map[string]*PcapIndexEntry)
+	}
+
+	return idx, nil
+}
+
+// lookup 返回未发生变化的文件对应的索引, 文件变化或不存在时返回 nil, 并删除已失效的索引
+func (idx *PcapIndex) lookup(path string, info os.FileInfo) *PcapIndexEntry {
+	if idx == nil || info == nil {
+		return nil
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	entry, ok := idx.Entries[path]
+	if !ok {
+		return nil
+	}
+	if !entry.matches(info) {
+		delete(idx.Entries, path)
+		idx.dirty = true
+		return nil
+	}
+	return entry
+}
+
+// store 保存(或覆盖)文件对应的索引, capinfos 获取的信息中没有 IPv6 标记, 由 storeIPv6 补充
+func (idx *PcapIndex) store(path string, info os.FileInfo, pcapInfo *PcapInfo) {
+	if idx == nil || info == nil {
+		return
+	}
+
+	entry := &PcapIndexEntry{
+		Path:        path,
+		Size:        info.Size(),
+		ModTime:     info.ModTime().UnixNano(),
+		SHA1:        pcapInfo.SHA1,
+		HasIPv6:     pcapInfo.hasIPv6,
+		IPv6Checked: pcapInfo.ipv6Checked,
+		Info:        *pcapInfo,
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.Entries[path] = entry
+	idx.dirty = true
+}
+
+// filteredPackets 返回索引中记录的文件经过 filter 过滤后剩余的 packet 数量
+func (idx *PcapIndex) filteredPackets(path string, filter string) (int64, bool) {
+	if idx == nil {
+		return 0, false
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	entry, ok := idx.Entries[path]
+	if !ok {
+		return 0, false
+	}
+	packets, ok := entry.FilteredPackets[filter]
+	return packets, ok
+}
+
+// storeFilteredPackets 记录文件经过 filter 过滤后剩余的 packet 数量, 文件没有索引时忽略
+func (idx *PcapIndex) storeFilteredPackets(path string, filter string, packets int64) {
+	if idx == nil {
+		return
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	entry, ok := idx.Entries[path]
+	if !ok {
+		return
+	}
+	if entry.FilteredPackets == nil {
+		entry.FilteredPackets = make(map[string]int64)
+	}
+	entry.FilteredPackets[filter] = packets
+	idx.dirty = true
+}
+
+// storeIPv6 记录单独检测的文件是否包含 IPv6 packet, 文件没有索引时忽略
+func (idx *PcapIndex) storeIPv6(path string, hasIPv6 bool) {
+	if idx == nil {
+		return
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	entry, ok := idx.Entries[path]
+	if !ok {
+		return
+	}
+	entry.HasIPv6 = hasIPv6
+	entry.IPv6Checked = true
+	idx.dirty = true
+}
+
+// storePreparation 记录文件准备工作的结果, 文件没有索引时忽略
+func (idx *PcapIndex) storePreparation(path string, preparation *PcapIndexPreparation) {
+	if idx == nil {
+		return
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	entry, ok := idx.Entries[path]
+	if !ok {
+		return
+	}
+	entry.Prepared = preparation
+	idx.dirty = true
+}
+
+// prune 删除文件已不存在或已变化的索引, 同时校验 SHA1, 返回删除的数量
+func (idx *PcapIndex) prune() int {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	count := 0
+	for path, entry := range idx.Entries {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() || !entry.matches(info) || !entry.verify(path) {
+			delete(idx.Entries, path)
+			count++
+		}
+	}
+	if count > 0 {
+		idx.dirty = true
+	}
+	return count
+}
+
+// save 将索引写回磁盘, 先写临时文件再重命名, 避免中断时损坏原有索引
+func (idx *PcapIndex) save() error {
+	if idx == nil {
+		return nil
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	if !idx.dirty {
+		return nil
+	}
+
+	content, err := json.Marshal(idx)
+	if err != nil {
+		return errors.New(fmt.Sprintf("can not marshal pcap index: %s", err))
+	}
+
+	err = os.MkdirAll(filepath.Dir(idx.path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	tmp := fmt.Sprintf("%s.%d.tmp", idx.path, os.Getpid())
+	err = ioutil.WriteFile(tmp, content, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, idx.path)
+	if err != nil {
+		deleteFile(tmp)
+		return err
+	}
+
+	idx.dirty = false
+	return nil
+}
+
+// matches 比较文件的大小和修改时间, 不读取文件内容
+func (e *PcapIndexEntry) matches(info os.FileInfo) bool {
+	return e.Size == info.Size() && e.ModTime == info.ModTime().UnixNano()
+}
+
+// verify 校验文件的 SHA1, 需要读取整个文件, 没有记录 SHA1 时视为一致
+func (e *PcapIndexEntry) verify(path string) bool {
+	if e.SHA1 == "" {
+		return true
+	}
+	sum, err := fileSHA1(path)
+	return err == nil && sum == e.SHA1
+}
+
+func fileSHA1(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha1.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// pcapInfo 还原出完整的 PcapInfo
+func (e *PcapIndexEntry) pcapInfo() *PcapInfo {
+	info := e.Info
+	_ = info.parse()
+	info.hasIPv6 = e.HasIPv6
+	info.ipv6Checked = e.IPv6Checked
+	return &info
+}
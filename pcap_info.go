@@ -1,9 +1,19 @@
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 var (
@@ -13,6 +23,7 @@ var (
 	PCAP_INFO_ERR_LAST_PACKET_TIME  int64 = 8
 	PCAP_INFO_ERR_AVG_PACKET_SIZE   int64 = 16
 	PCAP_INFO_ERR_AVG_PACKET_RATE   int64 = 32
+	PCAP_INFO_ERR_DATA_BIT_RATE     int64 = 64
 )
 
 type PcapInfo struct {
@@ -26,6 +37,7 @@ type PcapInfo struct {
 	EndTime         string `mapstructure:"end time"`
 	AvgPacketSize   string `mapstructure:"average packet size"`
 	AvgPacketRate   string `mapstructure:"average packet rate"`
+	DataBitRate     string `mapstructure:"data bit rate"`
 	SHA1            string `mapstructure:"sha1"`
 
 	packetCount     int64
@@ -34,6 +46,10 @@ type PcapInfo struct {
 	lastPacketTime  time.Time
 	avgPacketSize   float64
 	avgPacketRate   float64 // aka. pps
+	dataBitRate     float64 // aka. bps
+
+	hasIPv6     bool // 是否包含 IPv6 packet
+	ipv6Checked bool // hasIPv6 是否有效, 通过 capinfos 获取的信息无法得知
 
 	error int64
 }
@@ -76,12 +92,12 @@ func (p *PcapInfo) parse() error {
 		//return errors.New(fmt.Sprintf("no first packet time found"))
 	}
 	if firstPacketTime != "" {
-		ts, err := strconv.ParseFloat(firstPacketTime, 64)
+		ts, err := parsePacketTime(firstPacketTime)
 		if err != nil {
 			p.error |= PCAP_INFO_ERR_FIRST_PACKET_TIME
 			//return errors.New(fmt.Sprintf("errors when parse first packet time: %s", err))
 		} else {
-			p.firstPacketTime = time.Unix(int64(ts), 0)
+			p.firstPacketTime = ts
 		}
 	}
 
@@ -96,46 +112,276 @@ func (p *PcapInfo) parse() error {
 		//return errors.New(fmt.Sprintf("no last packet time found"))
 	}
 	if lastPacketTime != "" {
-		ts, err := strconv.ParseFloat(lastPacketTime, 64)
+		ts, err := parsePacketTime(lastPacketTime)
 		if err != nil {
 			p.error |= PCAP_INFO_ERR_LAST_PACKET_TIME
 			//return errors.New(fmt.Sprintf("errors when parse last packet time: %s", err))
 		} else {
-			p.lastPacketTime = time.Unix(int64(ts), 0)
+			p.lastPacketTime = ts
 		}
 	}
 
-	parts := strings.Split(p.AvgPacketSize, " ")
-	if parts == nil || len(parts) == 0 {
+	// capinfos 的输出可能带有千位分隔符和 k / M 等单位, 统一为与内置解析器一致的格式
+	if v, err := parseInfoValue(p.AvgPacketSize); err != nil {
 		p.avgPacketSize = -1
 		p.error |= PCAP_INFO_ERR_AVG_PACKET_SIZE
-		//return errors.New("average packet size is empty")
+		//return errors.New(fmt.Sprintf("errors when parse avg packet size: %s", err))
 	} else {
-		vf, err := strconv.ParseFloat(parts[0], 64)
-		if err != nil {
-			p.avgPacketSize = -1
-			p.error |= PCAP_INFO_ERR_AVG_PACKET_SIZE
-			//return errors.New(fmt.Sprintf("errors when parse avg packet size: %s", err))
-		} else {
-			p.avgPacketSize = vf
-		}
+		p.avgPacketSize = v
+		p.AvgPacketSize = fmt.Sprintf("%.2f bytes", v)
 	}
 
-	parts = strings.Split(p.AvgPacketRate, " ")
-	if parts == nil || len(parts) == 0 {
+	if v, err := parseInfoValue(p.AvgPacketRate); err != nil {
 		p.avgPacketRate = -1
 		p.error |= PCAP_INFO_ERR_AVG_PACKET_RATE
-		//return errors.New("average packet rate is empty")
+		//return errors.New(fmt.Sprintf("errors when parse pps: %s", err))
 	} else {
-		vf, err := strconv.ParseFloat(parts[0], 64)
+		p.avgPacketRate = v
+		p.AvgPacketRate = fmt.Sprintf("%.2f packets/s", v)
+	}
+
+	// 旧版本的索引中没有该字段
+	if v, err := parseInfoValue(p.DataBitRate); err != nil {
+		p.dataBitRate = -1
+		p.error |= PCAP_INFO_ERR_DATA_BIT_RATE
+	} else {
+		p.dataBitRate = v
+		p.DataBitRate = fmt.Sprintf("%.2f bits/s", v)
+	}
+
+	return nil
+}
+
+// parseInfoValue 解析 "1,234.5 kbps" 形式的数值, 去掉千位分隔符, 并按照单位的 k / M / G 前缀换算
+func parseInfoValue(s string) (float64, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty value")
+	}
+	v, err := strconv.ParseFloat(strings.Replace(fields[0], ",", "", -1), 64)
+	if err != nil {
+		return 0, err
+	}
+	if len(fields) > 1 && len(fields[1]) > 1 {
+		switch fields[1][0] {
+		case 'k', 'K':
+			v *= 1e3
+		case 'M':
+			v *= 1e6
+		case 'G':
+			v *= 1e9
+		}
+	}
+	return v, nil
+}
+
+// readPcapInfo 直接读取 pcap / pcapng 文件, 生成与 capinfos 输出一致的 PcapInfo, 不依赖任何外部命令
+func readPcapInfo(src string) (*PcapInfo, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("file %s not exist", src)
+		}
+		return nil, fmt.Errorf("cannot open file %s: %w", src, err)
+	}
+	defer f.Close()
+
+	hash := sha1.New()
+	tee := io.TeeReader(f, hash)
+
+	reader, format, err := newPcapReader(tee)
+	if err != nil {
+		return nil, err
+	}
+
+	collector := &pcapInfoCollector{}
+	for {
+		data, ci, err := reader.ZeroCopyReadPacketData()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			p.avgPacketRate = -1
-			p.error |= PCAP_INFO_ERR_AVG_PACKET_RATE
-			//return errors.New(fmt.Sprintf("errors when parse pps: %s", err))
-		} else {
-			p.avgPacketRate = vf
+			return nil, fmt.Errorf("error when read packet [%d]: %w", collector.packetCount, err)
 		}
+
+		collector.add(ci, packetLinkType(ci, reader.LinkType()), data)
 	}
 
-	return nil
+	// 确保 sha1 覆盖整个文件
+	if _, err = io.Copy(ioutil.Discard, tee); err != nil {
+		return nil, fmt.Errorf("error when read file %s: %w", src, err)
+	}
+
+	info := collector.info()
+	info.FileType = format.String()
+	if info.Encapsulation == "" {
+		info.Encapsulation = reader.LinkType().String()
+	}
+	info.SHA1 = hex.EncodeToString(hash.Sum(nil))
+
+	return info, nil
+}
+
+// pcapInfoCollector 逐个 packet 累计统计信息, 最终生成 PcapInfo
+type pcapInfoCollector struct {
+	packetCount int64
+	dataSize    int64
+	first       time.Time
+	last        time.Time
+	linkTypes   []layers.LinkType
+	hasIPv6     bool
+}
+
+func (c *pcapInfoCollector) add(ci gopacket.CaptureInfo, linkType layers.LinkType, data []byte) {
+	c.packetCount++
+	c.dataSize += int64(ci.Length)
+
+	if !c.hasIPv6 && isIPv6Frame(linkType, data) {
+		c.hasIPv6 = true
+	}
+
+	if c.first.IsZero() || ci.Timestamp.Before(c.first) {
+		c.first = ci.Timestamp
+	}
+	if c.last.IsZero() || ci.Timestamp.After(c.last) {
+		c.last = ci.Timestamp
+	}
+
+	for _, lt := range c.linkTypes {
+		if lt == linkType {
+			return
+		}
+	}
+	c.linkTypes = append(c.linkTypes, linkType)
+}
+
+func (c *pcapInfoCollector) info() *PcapInfo {
+	info := &PcapInfo{
+		PacketCount: strconv.FormatInt(c.packetCount, 10),
+		packetCount: c.packetCount,
+		hasIPv6:     c.hasIPv6,
+		ipv6Checked: true,
+	}
+
+	if len(c.linkTypes) == 1 {
+		info.Encapsulation = c.linkTypes[0].String()
+	} else if len(c.linkTypes) > 1 {
+		info.Encapsulation = "Per packet"
+	}
+
+	if c.packetCount == 0 {
+		info.CaptureDuration = "n/a"
+		info.FirstPacketTime = "n/a"
+		info.LastPacketTime = "n/a"
+		info.AvgPacketSize = "n/a"
+		info.AvgPacketRate = "n/a"
+		info.DataBitRate = "n/a"
+		info.avgPacketSize = -1
+		info.avgPacketRate = -1
+		info.dataBitRate = -1
+		info.error |= PCAP_INFO_ERR_DURATION | PCAP_INFO_ERR_FIRST_PACKET_TIME | PCAP_INFO_ERR_LAST_PACKET_TIME |
+			PCAP_INFO_ERR_AVG_PACKET_SIZE | PCAP_INFO_ERR_AVG_PACKET_RATE | PCAP_INFO_ERR_DATA_BIT_RATE
+		return info
+	}
+
+	info.firstPacketTime = c.first
+	info.lastPacketTime = c.last
+	info.FirstPacketTime = formatPacketTime(c.first)
+	info.LastPacketTime = formatPacketTime(c.last)
+
+	info.captureDuration = c.last.Sub(c.first)
+	info.CaptureDuration = fmt.Sprintf("%.9f seconds", info.captureDuration.Seconds())
+
+	info.avgPacketSize = float64(c.dataSize) / float64(c.packetCount)
+	info.AvgPacketSize = fmt.Sprintf("%.2f bytes", info.avgPacketSize)
+
+	// 与 capinfos 一致, 时长为 0 时无法计算 pps / bps
+	if info.captureDuration > 0 {
+		info.avgPacketRate = float64(c.packetCount) / info.captureDuration.Seconds()
+		info.AvgPacketRate = fmt.Sprintf("%.2f packets/s", info.avgPacketRate)
+		info.dataBitRate = float64(c.dataSize*8) / info.captureDuration.Seconds()
+		info.DataBitRate = fmt.Sprintf("%.2f bits/s", info.dataBitRate)
+	} else {
+		info.avgPacketRate = -1
+		info.AvgPacketRate = "n/a"
+		info.dataBitRate = -1
+		info.DataBitRate = "n/a"
+		info.error |= PCAP_INFO_ERR_AVG_PACKET_RATE | PCAP_INFO_ERR_DATA_BIT_RATE
+	}
+
+	return info
+}
+
+// parsePacketTime 解析 秒.小数 形式的时间, 保留到纳秒, 避免经过 float64 损失精度
+// 负数的整数和小数部分均为负, 比如 -1.5 表示 1970 年之前 1.5 秒
+func parsePacketTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	parts := strings.SplitN(strings.TrimPrefix(s, "-"), ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if sec < 0 {
+		return time.Time{}, fmt.Errorf("invalid time: %s", s)
+	}
+
+	var nsec int64
+	if len(parts) == 2 && parts[1] != "" {
+		frac := parts[1]
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		frac += strings.Repeat("0", 9-len(frac))
+		nsec, err = strconv.ParseInt(frac, 10, 64)
+		if err != nil || nsec < 0 {
+			return time.Time{}, fmt.Errorf("invalid fraction of time: %s", s)
+		}
+	}
+	if negative {
+		return time.Unix(-sec, -nsec), nil
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// formatPacketTime 以 秒.纳秒 的形式输出时间, 与 capinfos -S 的格式保持一致, 1970 年之前的时间输出为负数
+func formatPacketTime(t time.Time) string {
+	sec, nsec := t.Unix(), int64(t.Nanosecond())
+	if sec < 0 {
+		if nsec > 0 {
+			sec, nsec = sec+1, int64(time.Second)-nsec
+		}
+		return fmt.Sprintf("-%d.%09d", -sec, nsec)
+	}
+	return fmt.Sprintf("%d.%09d", sec, nsec)
+}
+
+// isIPv6Frame 仅检查链路层的协议类型字段判断是否为 IPv6 packet, 不做完整解码
+func isIPv6Frame(linkType layers.LinkType, data []byte) bool {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		offset := 12
+		for offset+2 <= len(data) {
+			etherType := layers.EthernetType(binary.BigEndian.Uint16(data[offset : offset+2]))
+			if etherType == layers.EthernetTypeDot1Q || etherType == layers.EthernetTypeQinQ {
+				offset += 4
+				continue
+			}
+			return etherType == layers.EthernetTypeIPv6
+		}
+	case layers.LinkTypeLinuxSLL:
+		if len(data) >= 16 {
+			return layers.EthernetType(binary.BigEndian.Uint16(data[14:16])) == layers.EthernetTypeIPv6
+		}
+	case layers.LinkTypeRaw, layers.LinkTypeIPv6, 12, 14: // 12 和 14 在部分系统上同样表示 raw IP
+		if len(data) >= 1 {
+			return data[0]>>4 == 6
+		}
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		// BSD 各系统的 AF_INET6 取值不同, 字节序也与抓包主机相关, 直接判断 IP 版本号更可靠
+		if len(data) > 4 {
+			return data[4]>>4 == 6
+		}
+	}
+	return false
 }
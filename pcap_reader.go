@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	// pcapng 文件以 Section Header Block 开头, 其 block type 固定为 0x0A0D0D0A
+	pcapngMagic uint32 = 0x0A0D0D0A
+	// 纳秒精度的 pcap 文件 magic, 分别对应小端和大端
+	pcapNanosMagic          uint32 = 0x4D3CB2A1
+	pcapNanosMagicBigEndian uint32 = 0xA1B23C4D
+)
+
+// pcapFormat 描述文件格式信息, 用于回写时保持一致
+type pcapFormat struct {
+	pcapNg     bool
+	nanosecond bool // pcap 格式的精度; pcapng 的精度由 interface 决定, 写出时为 true 表示将 interface 改为纳秒精度
+}
+
+func (f pcapFormat) String() string {
+	if f.pcapNg {
+		return "Wireshark/... - pcapng"
+	} else if f.nanosecond {
+		return "Wireshark/tcpdump/... - nanosecond libpcap"
+	}
+	return "Wireshark/tcpdump/... - pcap"
+}
+
+type pcapReader interface {
+	ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error)
+	ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error)
+	LinkType() layers.LinkType
+}
+
+// detectPcapFormat 根据文件头的 magic 判断文件格式, 不会消耗 reader 中的数据
+func detectPcapFormat(r *bufio.Reader) (pcapFormat, error) {
+	buf, err := r.Peek(4)
+	if err != nil {
+		return pcapFormat{}, fmt.Errorf("cannot read file magic: %w", err)
+	}
+	magic := binary.LittleEndian.Uint32(buf)
+	return pcapFormat{
+		pcapNg:     magic == pcapngMagic,
+		nanosecond: magic == pcapNanosMagic || magic == pcapNanosMagicBigEndian,
+	}, nil
+}
+
+// newPcapReader 自动识别 pcap / pcapng 格式并构建对应的 reader
+// pcapng 格式的 reader 会返回所有 interface 的 packet, 每个 packet 的 link type 见 packetLinkType
+func newPcapReader(r io.Reader) (pcapReader, pcapFormat, error) {
+	br := bufio.NewReader(r)
+
+	format, err := detectPcapFormat(br)
+	if err != nil {
+		return nil, format, err
+	}
+
+	if format.pcapNg {
+		source, err := newPcapngReader(br)
+		if err != nil {
+			return nil, format, fmt.Errorf("cannot build pcapng reader: %w", err)
+		}
+		return source, format, nil
+	}
+
+	source, err := pcapgo.NewReader(br)
+	if err != nil {
+		return nil, format, fmt.Errorf("cannot build pcap reader: %w", err)
+	}
+	return source, format, nil
+}
+
+// readPcapFileFormat 读取文件头判断文件格式
+func readPcapFileFormat(filename string) (pcapFormat, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return pcapFormat{}, fmt.Errorf("cannot open file %s: %w", filename, err)
+	}
+	defer file.Close()
+
+	return detectPcapFormat(bufio.NewReader(file))
+}
+
+// packetLinkType 返回 packet 的 link type, pcapng 中不同 interface 的 link type 可能不同
+func packetLinkType(ci gopacket.CaptureInfo, defaultLinkType layers.LinkType) layers.LinkType {
+	if len(ci.AncillaryData) > 0 {
+		if lt, ok := ci.AncillaryData[0].(layers.LinkType); ok {
+			return lt
+		}
+	}
+	return defaultLinkType
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	logger "github.com/sirupsen/logrus"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -26,6 +27,15 @@ func (p *PcapTool) String() string {
 	return "[Pcap Tool]"
 }
 
+// optionalTools 中的工具不存在时不视为错误, 仅将其路径置空, 使用方需自行判断是否可用
+var optionalTools = map[string]bool{
+	"capinfos":   true,
+	"editcap":    true,
+	"tcprewrite": true, // 仅用于将非以太网的 pcap 转换为以太网
+	"tcpprep":    true,
+	"mergecap":   true, // 内置的 merge 命令不依赖 mergecap, 仅供自定义命令使用
+}
+
 func (p *PcapTool) check() error {
 	for tool, path := range map[string]*string{
 		"bash":       &p.Bash,
@@ -37,16 +47,29 @@ func (p *PcapTool) check() error {
 		"tshark":     &p.Tshark,
 		"mergecap":   &p.MergeCap,
 	} {
+		if *path == "" && optionalTools[tool] {
+			continue
+		}
 		if !filepath.IsAbs(*path) {
 			// find in path
 			absPath, err := exec.LookPath(*path)
 			if err != nil {
+				if optionalTools[tool] {
+					logger.Debugf("optional command %s not found in $PATH, ignore it\n", tool)
+					*path = ""
+					continue
+				}
 				return errors.New(fmt.Sprintf("command %s not found in $PATH", tool))
 			}
 			// update to abs
 			*path = absPath
 		}
 		s, err := os.Stat(*path)
+		if os.IsNotExist(err) && optionalTools[tool] {
+			logger.Debugf("optional command %s not found at %s, ignore it\n", tool, *path)
+			*path = ""
+			continue
+		}
 		if os.IsNotExist(err) {
 			return errors.New(fmt.Sprintf("command %s not found at %s", tool, *path))
 		}
@@ -57,14 +80,6 @@ func (p *PcapTool) check() error {
 	return nil
 }
 
-func (p *PcapTool) pcapng2pcap(src, dst string) *ExecResult {
-	return execShellCommand(fmt.Sprintf("%s -F pcap %s %s", p.Editcap, src, dst), config.CommandTimeout)
-}
-
-func (p *PcapTool) adjustTime(src, dst string, timeOffset int64) *ExecResult {
-	return execShellCommand(fmt.Sprintf("%s -t %d -F pcap %s %s", p.Editcap, timeOffset, src, dst), config.CommandTimeout)
-}
-
 func (p *PcapTool) generateCache(src, dst string, timeout time.Duration) *ExecResult {
 	if timeout == 0 {
 		timeout = config.CommandTimeout
@@ -72,23 +87,6 @@ func (p *PcapTool) generateCache(src, dst string, timeout time.Duration) *ExecRe
 	return execShellCommand(fmt.Sprintf("%s -a client --pcap=%s --cachefile=%s --nonip", p.Tcpprep, src, dst), timeout)
 }
 
-func (p *PcapTool) modifyIp(src, dst, cache, endpoints string, timeout time.Duration) *ExecResult {
-	if timeout == 0 {
-		timeout = config.CommandTimeout
-	}
-
-	cacheFilePath := fmt.Sprintf("%s.cache", dst)
-	result := pcapTool.generateCache(src, cacheFilePath, 0)
-	if !result.succeed {
-		return result
-	}
-	defer deleteFile(cacheFilePath)
-
-	cmd := fmt.Sprintf("%s --fixcsum --infile=%s --outfile=%s --skipbroadcast --cachefile=%s --endpoints=%s",
-		p.Tcprewrite, src, dst, cacheFilePath, endpoints)
-	return execShellCommand(cmd, timeout)
-}
-
 func (p *PcapTool) convertDLT2Ethernet(src, dst string, timeout time.Duration) *ExecResult {
 	if timeout == 0 {
 		timeout = config.CommandTimeout
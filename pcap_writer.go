@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/google/gopacket/pcapgo"
+)
+
+const defaultSnaplen uint32 = 65536
+
+// readerSnaplen 返回源文件的 snaplen, 无法获取时使用默认值
+func readerSnaplen(reader pcapReader) uint32 {
+	if r, ok := reader.(interface{ Snaplen() uint32 }); ok && r.Snaplen() > 0 {
+		return r.Snaplen()
+	}
+	return defaultSnaplen
+}
+
+// newPcapWriter 按照给定的格式创建 writer, link type 和 snaplen 与 reader 保持一致, 返回的 flush 必须在关闭文件前调用
+// 当 reader 与 writer 均为 pcapng 时, section / interface 等 block 由 reader 原样转交给 writer,
+// format.nanosecond 为 true 时转交的 interface 改为纳秒精度
+func newPcapWriter(w io.Writer, reader pcapReader, format pcapFormat) (pcapWriter, func() error, error) {
+	if format.pcapNg {
+		writer := newPcapngWriter(w)
+		writer.nanosecond = format.nanosecond
+		var err error
+		if ngReader, ok := reader.(*pcapngReader); ok {
+			err = ngReader.setPassthrough(writer.writeBlock)
+		} else {
+			err = writer.writeHeader(reader.LinkType(), readerSnaplen(reader))
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot build pcapng writer: %w", err)
+		}
+		return writer, writer.Flush, nil
+	}
+
+	var writer *pcapgo.Writer
+	if format.nanosecond {
+		writer = pcapgo.NewWriterNanos(w)
+	} else {
+		writer = pcapgo.NewWriter(w)
+	}
+	err := writer.WriteFileHeader(readerSnaplen(reader), reader.LinkType())
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot build pcap writer (error when write file header): %w", err)
+	}
+	return writer, func() error { return nil }, nil
+}
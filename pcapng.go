@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pcapng 的 block 类型, 参考 https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-03.html
+const (
+	pcapngBlockObsoletePacket  uint32 = 0x00000002
+	pcapngBlockSimplePacket    uint32 = 0x00000003
+	pcapngBlockEnhancedPacket  uint32 = 0x00000006
+	pcapngBlockInterface       uint32 = 0x00000001
+	pcapngBlockSectionHeader          = pcapngMagic
+	pcapngByteOrderMagic       uint32 = 0x1A2B3C4D
+	pcapngMaxBlockSize         uint32 = 64 * 1024 * 1024
+	pcapngOptionEndOfOpt       uint16 = 0
+	pcapngOptionEPBHash        uint16 = 3
+	pcapngOptionIfTsresol      uint16 = 9
+	pcapngOptionIfTsoffset     uint16 = 14
+	pcapngDefaultTsUnits       uint64 = 1000000
+	pcapngEnhancedPacketHeader        = 20
+)
+
+// pcapngPacketOptions 是 packet block 中的原始 options (不含 epb_hash), 通过 CaptureInfo.AncillaryData 传递给 writer
+type pcapngPacketOptions []byte
+
+// pcapngInterface 记录 interface 中与 packet 解析相关的信息, 其余内容随 block 原样回写
+type pcapngInterface struct {
+	linkType layers.LinkType
+	snaplen  uint32
+	tsUnits  uint64 // 每秒的时间戳单位数
+	tsOffset int64  // 秒
+}
+
+// parsePcapngInterface 解析完整的 Interface Description Block
+func parsePcapngInterface(block []byte, byteOrder binary.ByteOrder) (pcapngInterface, error) {
+	if len(block) < 20 {
+		return pcapngInterface{}, fmt.Errorf("interface block too short (%d bytes)", len(block))
+	}
+	intf := pcapngInterface{
+		linkType: layers.LinkType(byteOrder.Uint16(block[8:10])),
+		snaplen:  byteOrder.Uint32(block[12:16]),
+		tsUnits:  pcapngDefaultTsUnits,
+	}
+
+	err := walkPcapngOptions(block[16:len(block)-4], byteOrder, func(code uint16, value []byte) {
+		switch {
+		case code == pcapngOptionIfTsresol && len(value) >= 1:
+			if value[0]&0x80 == 0 {
+				intf.tsUnits = 1
+				for i := uint8(0); i < value[0] && i < 19; i++ {
+					intf.tsUnits *= 10
+				}
+			} else {
+				intf.tsUnits = 1 << (value[0] & 0x3f)
+			}
+		case code == pcapngOptionIfTsoffset && len(value) >= 8:
+			intf.tsOffset = int64(byteOrder.Uint64(value))
+		}
+	})
+	return intf, err
+}
+
+// walkPcapngOptions 依次遍历 options, 遇到 opt_endofopt 停止
+func walkPcapngOptions(options []byte, byteOrder binary.ByteOrder, f func(code uint16, value []byte)) error {
+	for len(options) >= 4 {
+		code, length := byteOrder.Uint16(options[0:2]), int(byteOrder.Uint16(options[2:4]))
+		if code == pcapngOptionEndOfOpt {
+			return nil
+		}
+		padded := (length + 3) &^ 3
+		if 4+padded > len(options) {
+			return fmt.Errorf("option %d exceeds block", code)
+		}
+		f(code, options[4:4+length])
+		options = options[4+padded:]
+	}
+	return nil
+}
+
+// packetOptions 复制 packet block 中的 options, 去除在 packet 修改后会失效的 epb_hash
+func packetOptions(options []byte, byteOrder binary.ByteOrder) pcapngPacketOptions {
+	var kept []byte
+	_ = walkPcapngOptions(options, byteOrder, func(code uint16, value []byte) {
+		if code == pcapngOptionEPBHash {
+			return
+		}
+		kept = appendPcapngOption(kept, code, value, byteOrder)
+	})
+	if len(kept) == 0 {
+		return nil
+	}
+	return append(kept, 0, 0, 0, 0)
+}
+
+// appendPcapngOption 在 options 末尾追加一个按 4 字节对齐的 option
+func appendPcapngOption(options []byte, code uint16, value []byte, byteOrder binary.ByteOrder) []byte {
+	opt := make([]byte, 4+(len(value)+3)&^3)
+	byteOrder.PutUint16(opt[0:2], code)
+	byteOrder.PutUint16(opt[2:4], uint16(len(value)))
+	copy(opt[4:], value)
+	return append(options, opt...)
+}
+
+// nanosecondInterface 将 Interface Description Block 的 if_tsresol 改为纳秒, 其余 options 原样保留
+func nanosecondInterface(block []byte, byteOrder binary.ByteOrder) ([]byte, error) {
+	if len(block) < 20 {
+		return nil, fmt.Errorf("interface block too short (%d bytes)", len(block))
+	}
+	idb := append([]byte(nil), block[:16]...)
+	err := walkPcapngOptions(block[16:len(block)-4], byteOrder, func(code uint16, value []byte) {
+		if code != pcapngOptionIfTsresol {
+			idb = appendPcapngOption(idb, code, value, byteOrder)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	idb = appendPcapngOption(idb, pcapngOptionIfTsresol, []byte{9}, byteOrder)
+	idb = append(idb, 0, 0, 0, 0, 0, 0, 0, 0) // opt_endofopt 和 block 末尾的长度
+	byteOrder.PutUint32(idb[4:8], uint32(len(idb)))
+	byteOrder.PutUint32(idb[len(idb)-4:], uint32(len(idb)))
+	return idb, nil
+}
+
+// pcapngTimestamp 将 interface 单位的时间戳转换为 time.Time
+func pcapngTimestamp(ts uint64, intf pcapngInterface) time.Time {
+	secs, frac := ts/intf.tsUnits, ts%intf.tsUnits
+	hi, lo := bits.Mul64(frac, uint64(time.Second))
+	nanos, _ := bits.Div64(hi, lo, intf.tsUnits)
+	return time.Unix(int64(secs)+intf.tsOffset, int64(nanos)).UTC()
+}
+
+// pcapngTimestampUnits 将 time.Time 转换为 interface 单位的时间戳, 超出 interface 精度的部分被截断
+func pcapngTimestampUnits(t time.Time, intf pcapngInterface) uint64 {
+	secs := uint64(t.Unix() - intf.tsOffset)
+	hi, lo := bits.Mul64(uint64(t.Nanosecond()), intf.tsUnits)
+	frac, _ := bits.Div64(hi, lo, uint64(time.Second))
+	return secs*intf.tsUnits + frac
+}
+
+// pcapngReader 按 block 读取 pcapng 文件
+// 与 pcapgo.NgReader 不同, packet 以外的 block (section / interface / statistics / 注释等) 均原样交给 passthrough,
+// packet 的 options (如注释) 通过 CaptureInfo.AncillaryData 传出, 从而可以无损回写
+// CaptureInfo.AncillaryData[0] 总是该 packet 所属 interface 的 link type
+type pcapngReader struct {
+	r          *bufio.Reader
+	byteOrder  binary.ByteOrder
+	interfaces []pcapngInterface
+	linkType   layers.LinkType
+
+	pending     [][]byte // 创建 reader 时读取到的 block, 在设置 passthrough 时输出
+	passthrough func(block []byte) error
+}
+
+// newPcapngReader 读取到第一个 interface 为止, 以确定文件的 link type
+func newPcapngReader(r *bufio.Reader) (*pcapngReader, error) {
+	reader := &pcapngReader{r: r}
+
+	for len(reader.interfaces) == 0 {
+		blockType, block, err := reader.readBlock()
+		if err == io.EOF {
+			return nil, fmt.Errorf("pcapng file has no interface")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isPcapngPacketBlock(blockType) {
+			return nil, fmt.Errorf("pcapng packet block appears before any interface")
+		}
+		if err = reader.handleBlock(blockType, block); err != nil {
+			return nil, err
+		}
+		reader.pending = append(reader.pending, block)
+	}
+	reader.linkType = reader.interfaces[0].linkType
+
+	return reader, nil
+}
+
+func isPcapngPacketBlock(blockType uint32) bool {
+	return blockType == pcapngBlockEnhancedPacket || blockType == pcapngBlockSimplePacket || blockType == pcapngBlockObsoletePacket
+}
+
+// readBlock 读取一个完整的 block, section header 会同时更新字节序
+func (r *pcapngReader) readBlock() (uint32, []byte, error) {
+	header, err := r.r.Peek(12)
+	if err != nil {
+		if err == io.EOF && len(header) == 0 {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, fmt.Errorf("cannot read pcapng block header: %w", io.ErrUnexpectedEOF)
+	}
+
+	if binary.LittleEndian.Uint32(header[0:4]) == pcapngBlockSectionHeader {
+		if binary.LittleEndian.Uint32(header[8:12]) == pcapngByteOrderMagic {
+			r.byteOrder = binary.LittleEndian
+		} else if binary.BigEndian.Uint32(header[8:12]) == pcapngByteOrderMagic {
+			r.byteOrder = binary.BigEndian
+		} else {
+			return 0, nil, fmt.Errorf("invalid pcapng byte order magic")
+		}
+	} else if r.byteOrder == nil {
+		return 0, nil, fmt.Errorf("pcapng file does not start with section header")
+	}
+
+	blockType := r.byteOrder.Uint32(header[0:4])
+	length := r.byteOrder.Uint32(header[4:8])
+	if length < 12 || length%4 != 0 || length > pcapngMaxBlockSize {
+		return 0, nil, fmt.Errorf("invalid pcapng block length %d", length)
+	}
+
+	block := make([]byte, length)
+	if _, err = io.ReadFull(r.r, block); err != nil {
+		return 0, nil, fmt.Errorf("cannot read pcapng block: %w", io.ErrUnexpectedEOF)
+	}
+	return blockType, block, nil
+}
+
+// handleBlock 处理 packet 以外的 block, 未设置 passthrough 时丢弃
+func (r *pcapngReader) handleBlock(blockType uint32, block []byte) error {
+	switch blockType {
+	case pcapngBlockSectionHeader:
+		r.interfaces = r.interfaces[:0]
+	case pcapngBlockInterface:
+		intf, err := parsePcapngInterface(block, r.byteOrder)
+		if err != nil {
+			return err
+		}
+		r.interfaces = append(r.interfaces, intf)
+	}
+
+	if r.passthrough == nil {
+		return nil
+	}
+	return r.passthrough(block)
+}
+
+// setPassthrough 设置 packet 以外 block 的输出, 之前已读取的 block 立即输出
+func (r *pcapngReader) setPassthrough(f func(block []byte) error) error {
+	for _, block := range r.pending {
+		if err := f(block); err != nil {
+			return err
+		}
+	}
+	r.pending = nil
+	r.passthrough = f
+	return nil
+}
+
+func (r *pcapngReader) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	for {
+		blockType, block, err := r.readBlock()
+		if err != nil {
+			return nil, ci, err
+		}
+		if !isPcapngPacketBlock(blockType) {
+			if err = r.handleBlock(blockType, block); err != nil {
+				return nil, ci, err
+			}
+			continue
+		}
+		return r.parsePacket(blockType, block)
+	}
+}
+
+func (r *pcapngReader) ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	return r.ReadPacketData()
+}
+
+func (r *pcapngReader) parsePacket(blockType uint32, block []byte) (data []byte, ci gopacket.CaptureInfo, err error) {
+	body := block[8 : len(block)-4]
+
+	var interfaceID int
+	var ts uint64
+	var offset int
+
+	switch blockType {
+	case pcapngBlockSimplePacket:
+		if len(body) < 4 {
+			return nil, ci, fmt.Errorf("simple packet block too short")
+		}
+		if len(r.interfaces) == 0 {
+			return nil, ci, fmt.Errorf("simple packet block appears before any interface")
+		}
+		ci.Length = int(r.byteOrder.Uint32(body[0:4]))
+		ci.CaptureLength = ci.Length
+		if snaplen := int(r.interfaces[0].snaplen); snaplen > 0 && ci.CaptureLength > snaplen {
+			ci.CaptureLength = snaplen
+		}
+		offset = 4
+	case pcapngBlockObsoletePacket, pcapngBlockEnhancedPacket:
+		if len(body) < pcapngEnhancedPacketHeader {
+			return nil, ci, fmt.Errorf("packet block too short")
+		}
+		if blockType == pcapngBlockObsoletePacket {
+			interfaceID = int(r.byteOrder.Uint16(body[0:2]))
+		} else {
+			interfaceID = int(r.byteOrder.Uint32(body[0:4]))
+		}
+		ts = uint64(r.byteOrder.Uint32(body[4:8]))<<32 | uint64(r.byteOrder.Uint32(body[8:12]))
+		ci.CaptureLength = int(r.byteOrder.Uint32(body[12:16]))
+		ci.Length = int(r.byteOrder.Uint32(body[16:20]))
+		offset = pcapngEnhancedPacketHeader
+	}
+
+	if interfaceID >= len(r.interfaces) {
+		return nil, ci, fmt.Errorf("packet refers to unknown interface %d", interfaceID)
+	}
+	if offset+ci.CaptureLength > len(body) {
+		return nil, ci, fmt.Errorf("packet capture length %d exceeds block", ci.CaptureLength)
+	}
+
+	intf := r.interfaces[interfaceID]
+	data = body[offset : offset+ci.CaptureLength]
+	ci.InterfaceIndex = interfaceID
+	ci.AncillaryData = []interface{}{intf.linkType}
+	if blockType != pcapngBlockSimplePacket {
+		ci.Timestamp = pcapngTimestamp(ts, intf)
+		// 没有 padding 或 options 时 padding 后的位置可能超出 block
+		if padded := offset + (ci.CaptureLength+3)&^3; padded < len(body) {
+			if options := packetOptions(body[padded:], r.byteOrder); options != nil {
+				ci.AncillaryData = append(ci.AncillaryData, options)
+			}
+		}
+	}
+	return data, ci, nil
+}
+
+func (r *pcapngReader) LinkType() layers.LinkType {
+	return r.linkType
+}
+
+// Snaplen 返回第一个 interface 的 snaplen
+func (r *pcapngReader) Snaplen() uint32 {
+	return r.interfaces[0].snaplen
+}
+
+// pcapngWriter 写出 pcapng 文件, 与 pcapngReader 配合使用时 packet 以外的 block 原样回写,
+// 否则自动生成一个 section header 和一个 interface
+type pcapngWriter struct {
+	w          *bufio.Writer
+	byteOrder  binary.ByteOrder
+	interfaces []pcapngInterface
+
+	nanosecond bool // 回写的 interface 是否改为纳秒精度, 避免调整后的纳秒时间戳被截断
+}
+
+func newPcapngWriter(w io.Writer) *pcapngWriter {
+	return &pcapngWriter{w: bufio.NewWriter(w), byteOrder: binary.LittleEndian}
+}
+
+// writeHeader 生成默认的 section header 和纳秒精度的 interface
+func (w *pcapngWriter) writeHeader(linkType layers.LinkType, snaplen uint32) error {
+	if err := w.writeSectionHeader(); err != nil {
+		return err
+	}
+	_, err := w.writeInterface(linkType, snaplen)
+	return err
+}
+
+// writeSectionHeader 生成默认的 section header
+func (w *pcapngWriter) writeSectionHeader() error {
+	shb := make([]byte, 28)
+	w.byteOrder.PutUint32(shb[0:4], pcapngBlockSectionHeader)
+	w.byteOrder.PutUint32(shb[4:8], uint32(len(shb)))
+	w.byteOrder.PutUint32(shb[8:12], pcapngByteOrderMagic)
+	w.byteOrder.PutUint16(shb[12:14], 1) // major version
+	w.byteOrder.PutUint64(shb[16:24], 0xFFFFFFFFFFFFFFFF)
+	w.byteOrder.PutUint32(shb[24:28], uint32(len(shb)))
+	return w.writeBlock(shb)
+}
+
+// writeInterface 在当前 section 中追加一个纳秒精度的 interface, 返回其序号
+func (w *pcapngWriter) writeInterface(linkType layers.LinkType, snaplen uint32) (int, error) {
+	idb := make([]byte, 32)
+	w.byteOrder.PutUint32(idb[0:4], pcapngBlockInterface)
+	w.byteOrder.PutUint32(idb[4:8], uint32(len(idb)))
+	w.byteOrder.PutUint16(idb[8:10], uint16(linkType))
+	w.byteOrder.PutUint32(idb[12:16], snaplen)
+	w.byteOrder.PutUint16(idb[16:18], pcapngOptionIfTsresol)
+	w.byteOrder.PutUint16(idb[18:20], 1)
+	idb[20] = 9
+	w.byteOrder.PutUint32(idb[28:32], uint32(len(idb)))
+	if err := w.writeBlock(idb); err != nil {
+		return 0, err
+	}
+	return len(w.interfaces) - 1, nil
+}
+
+// writeBlock 原样写出 packet 以外的 block, 并记录 section / interface 信息
+func (w *pcapngWriter) writeBlock(block []byte) error {
+	if binary.LittleEndian.Uint32(block[0:4]) == pcapngBlockSectionHeader {
+		if binary.BigEndian.Uint32(block[8:12]) == pcapngByteOrderMagic {
+			w.byteOrder = binary.BigEndian
+		} else {
+			w.byteOrder = binary.LittleEndian
+		}
+		w.interfaces = w.interfaces[:0]
+	} else if w.byteOrder.Uint32(block[0:4]) == pcapngBlockInterface {
+		if w.nanosecond {
+			var err error
+			if block, err = nanosecondInterface(block, w.byteOrder); err != nil {
+				return err
+			}
+		}
+		intf, err := parsePcapngInterface(block, w.byteOrder)
+		if err != nil {
+			return err
+		}
+		w.interfaces = append(w.interfaces, intf)
+	}
+
+	_, err := w.w.Write(block)
+	return err
+}
+
+// WritePacket 以 Enhanced Packet Block 写出 packet, 时间戳使用所属 interface 的精度
+func (w *pcapngWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	if ci.InterfaceIndex < 0 || ci.InterfaceIndex >= len(w.interfaces) {
+		return fmt.Errorf("packet refers to unknown interface %d", ci.InterfaceIndex)
+	}
+	if ci.CaptureLength != len(data) {
+		return fmt.Errorf("capture length %d does not match data length %d", ci.CaptureLength, len(data))
+	}
+
+	var options pcapngPacketOptions
+	for _, v := range ci.AncillaryData {
+		if o, ok := v.(pcapngPacketOptions); ok {
+			options = o
+		}
+	}
+
+	padded := (len(data) + 3) &^ 3
+	length := 8 + pcapngEnhancedPacketHeader + padded + len(options) + 4
+	ts := pcapngTimestampUnits(ci.Timestamp, w.interfaces[ci.InterfaceIndex])
+
+	header := make([]byte, 8+pcapngEnhancedPacketHeader)
+	w.byteOrder.PutUint32(header[0:4], pcapngBlockEnhancedPacket)
+	w.byteOrder.PutUint32(header[4:8], uint32(length))
+	w.byteOrder.PutUint32(header[8:12], uint32(ci.InterfaceIndex))
+	w.byteOrder.PutUint32(header[12:16], uint32(ts>>32))
+	w.byteOrder.PutUint32(header[16:20], uint32(ts))
+	w.byteOrder.PutUint32(header[20:24], uint32(ci.CaptureLength))
+	w.byteOrder.PutUint32(header[24:28], uint32(ci.Length))
+
+	trailer := make([]byte, padded-len(data)+len(options)+4)
+	copy(trailer[padded-len(data):], options)
+	w.byteOrder.PutUint32(trailer[len(trailer)-4:], uint32(length))
+
+	if _, err := w.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	_, err := w.w.Write(trailer)
+	return err
+}
+
+func (w *pcapngWriter) Flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,917 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	logger "github.com/sirupsen/logrus"
+)
+
+// packetRecord 是流水线中传递的单个 packet
+type packetRecord struct {
+	ci    gopacket.CaptureInfo
+	data  []byte
+	index int // 在源文件中的序号
+
+	fromClient bool // 源地址是否为客户端, 由源文件中的原始地址判断, 不受之前步骤的影响
+
+	linkType layers.LinkType
+	packet   gopacket.Packet // 延迟解码, data 变化后失效
+}
+
+// decoded 返回解码后的 packet, 多个步骤之间共享解码结果
+func (r *packetRecord) decoded() gopacket.Packet {
+	if r.packet == nil {
+		r.packet = gopacket.NewPacket(r.data, r.linkType, gopacket.Default)
+	}
+	return r.packet
+}
+
+// setData 替换 packet 内容, 之前的解码结果随之失效
+func (r *packetRecord) setData(data []byte) {
+	r.data = data
+	r.packet = nil
+}
+
+type emitFunc func(r *packetRecord) error
+
+// packetStage 是流水线中的一个修改步骤
+// process 处理单个 packet, 通过 emit 向后续步骤输出零个或多个 packet
+// flush 在全部 packet 处理完成后调用, 用于输出缓存的 packet 或者做最终检查
+type packetStage interface {
+	process(r *packetRecord, emit emitFunc) error
+	flush(emit emitFunc) error
+}
+
+// packetPipeline 读取一次源文件, 依次经过所有步骤后写出一次, 避免每个步骤都完整读写一次文件
+type packetPipeline struct {
+	stages     []packetStage
+	classifier *endpointClassifier // 为 nil 时所有 packet 视为客户端发出
+
+	nanosecond bool // 是否强制以纳秒精度写出
+
+	info *PcapInfo // 生成的 pcap 的信息, run 成功后有效
+}
+
+func (pl *packetPipeline) run(oldFilename, newFilename string) error {
+	oldFile, err := os.Open(oldFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("file %s not exist", oldFilename)
+		} else {
+			return fmt.Errorf("cannot open file %s: %w", oldFilename, err)
+		}
+	}
+	defer oldFile.Close()
+
+	newFile, err := os.OpenFile(newFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot create (and truncate) file %s: %w", newFilename, err)
+	}
+	defer newFile.Close()
+
+	reader, format, err := newPcapReader(newProgressReader(oldFile))
+	if err != nil {
+		return err
+	}
+
+	// 保持源文件的格式, pcap 格式或 pcapng 的 interface 在需要时提升为纳秒精度
+	format.nanosecond = format.nanosecond || pl.nanosecond
+	writer, flush, err := newPcapWriter(newFile, reader, format)
+	if err != nil {
+		return err
+	}
+	defer flush()
+
+	collector := &pcapInfoCollector{}
+	writer = &infoWriter{pcapWriter: writer, linkType: reader.LinkType(), collector: collector}
+	written, err := streamPackets(reader, writer, pl.stages, pl.classifier)
+	if err != nil {
+		return err
+	}
+	if written == 0 {
+		return fmt.Errorf("no packets left after modification")
+	}
+	pl.info = collector.info()
+	pl.info.FileType = format.String()
+	return nil
+}
+
+// infoWriter 在写出的同时统计生成的 pcap 的信息, 避免再读一次文件
+type infoWriter struct {
+	pcapWriter
+	linkType  layers.LinkType
+	collector *pcapInfoCollector
+}
+
+func (w *infoWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	if err := w.pcapWriter.WritePacket(ci, data); err != nil {
+		return err
+	}
+	w.collector.add(ci, packetLinkType(ci, w.linkType), data)
+	return nil
+}
+
+// streamPackets 逐个读取 packet, 依次经过所有步骤后立即写出, 返回写出的 packet 数量
+// 内存占用与文件大小无关, shufflePacketStage 只为每个 packet 保留其在临时文件中的位置
+// 实现了 io.Closer 的步骤在结束时关闭, 用于清理临时文件
+func streamPackets(reader pcapReader, writer pcapWriter, stages []packetStage, classifier *endpointClassifier) (int, error) {
+	for _, stage := range stages {
+		if closer, ok := stage.(io.Closer); ok {
+			defer closer.Close()
+		}
+	}
+
+	written := 0
+	emits := make([]emitFunc, len(stages)+1)
+	emits[len(stages)] = func(r *packetRecord) error {
+		ci := r.ci
+		ci.Length += len(r.data) - ci.CaptureLength
+		ci.CaptureLength = len(r.data)
+		if err := writer.WritePacket(ci, r.data); err != nil {
+			return fmt.Errorf("error when write modified packet [%d] to file: %w", r.index, err)
+		}
+		written++
+		return nil
+	}
+	for i := len(stages) - 1; i >= 0; i-- {
+		stage, next := stages[i], emits[i+1]
+		emits[i] = func(r *packetRecord) error {
+			return stage.process(r, next)
+		}
+	}
+
+	for i := 0; ; i++ {
+		data, ci, err := reader.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, fmt.Errorf("error when read packet [%d]: %w", i, err)
+		}
+
+		r := &packetRecord{
+			ci:         ci,
+			data:       data,
+			index:      i,
+			fromClient: true,
+			linkType:   packetLinkType(ci, reader.LinkType()),
+		}
+		if classifier != nil {
+			if view, ok := parseIPPacketView(data); ok {
+				r.fromClient = classifier.isClient(view.src)
+			}
+		}
+
+		if err = emits[0](r); err != nil {
+			return written, err
+		}
+	}
+
+	for i, stage := range stages {
+		if err := stage.flush(emits[i+1]); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// p426Stage 将 IPv4 packet 转换为 IPv6
+type p426Stage struct {
+	translator *ipv4To6Translator
+}
+
+func (s *p426Stage) process(r *packetRecord, emit emitFunc) error {
+	if r.linkType != layers.LinkTypeEthernet {
+		return emit(r)
+	}
+	b, err := s.translator.translate(r.data)
+	if err != nil {
+		logger.Debugf("Cannot convert packet [%d], not modify. (%s)\n", r.index, err)
+	} else {
+		r.setData(b)
+	}
+	return emit(r)
+}
+
+func (s *p426Stage) flush(emit emitFunc) error {
+	return nil
+}
+
+// p624Stage 将 IPv6 packet 转换为 IPv4
+type p624Stage struct {
+	translator *ipv6To4Translator
+}
+
+func (s *p624Stage) process(r *packetRecord, emit emitFunc) error {
+	if r.linkType != layers.LinkTypeEthernet {
+		return emit(r)
+	}
+	b, err := s.translator.translate(r.data)
+	if err != nil {
+		logger.Debugf("Cannot convert packet [%d], not modify. (%s)\n", r.index, err)
+	} else {
+		r.setData(b)
+	}
+	return emit(r)
+}
+
+func (s *p624Stage) flush(emit emitFunc) error {
+	return nil
+}
+
+// shufflePayloadStage 保留 payload 的前 keepN 个字节, 打乱剩余部分
+type shufflePayloadStage struct {
+	keepN    int
+	rand     *rand.Rand
+	shuffled int
+}
+
+func (s *shufflePayloadStage) process(r *packetRecord, emit emitFunc) error {
+	b, err := shufflePacketPayload(r.decoded(), s.keepN, s.rand)
+	if err != nil {
+		logger.Debugf("Cannot shuffle packet [%d], not modify. (%s)\n", r.index, err)
+	} else {
+		r.setData(b)
+		s.shuffled++
+	}
+	return emit(r)
+}
+
+func (s *shufflePayloadStage) flush(emit emitFunc) error {
+	if s.shuffled == 0 {
+		return fmt.Errorf("can not shuffle any packet")
+	}
+	return nil
+}
+
+// mutatePayloadStage 按照选定的策略修改 payload, 改变了长度时修正同一个 TCP 连接中之后的 seq 和对端的 ack
+// 重传的数据不改变长度, 以免同一段数据在重传中被修改为不同的长度; IP 分片不做修改
+type mutatePayloadStage struct {
+	mutation *payloadMutation
+	flows    map[tcpFlowKey]*tcpSeqShift
+	mutated  int
+}
+
+func newMutatePayloadStage(mutation *payloadMutation) *mutatePayloadStage {
+	return &mutatePayloadStage{
+		mutation: mutation,
+		flows:    make(map[tcpFlowKey]*tcpSeqShift),
+	}
+}
+
+func (s *mutatePayloadStage) flow(key tcpFlowKey) *tcpSeqShift {
+	shift, ok := s.flows[key]
+	if !ok {
+		shift = &tcpSeqShift{}
+		s.flows[key] = shift
+	}
+	return shift
+}
+
+func (s *mutatePayloadStage) process(r *packetRecord, emit emitFunc) error {
+	packet := r.decoded()
+	if isFragment(packet) {
+		return emit(r)
+	}
+
+	mutated, shifted := false, false
+	mutate := func(payload []byte) []byte {
+		result := s.mutation.mutate(payload)
+		mutated = mutated || !bytes.Equal(result, payload)
+		return result
+	}
+
+	var rewriteTCP func(tcp *layers.TCP, oldLen, newLen int)
+	if network, tcp := findTCP(packet); tcp != nil && s.mutation.changesLength() {
+		key := tcpFlowKey{network: network.NetworkFlow(), transport: tcp.TransportFlow()}
+		shift := s.flow(key)
+		peer := s.flow(tcpFlowKey{network: key.network.Reverse(), transport: key.transport.Reverse()})
+		if len(tcp.Payload) > 0 && shift.retransmitted(tcp.Seq) {
+			mutate = nil
+		}
+
+		rewriteTCP = func(tcp *layers.TCP, oldLen, newLen int) {
+			seq, length := tcp.Seq, len(tcp.Payload)
+			if tcp.SYN || tcp.FIN {
+				length++
+			}
+			shift.record(seq, length, newLen-oldLen)
+			seqOffset, ackOffset := shift.offset(seq), uint32(0)
+			if tcp.ACK {
+				ackOffset = peer.offset(tcp.Ack)
+			}
+			tcp.Seq += seqOffset
+			tcp.Ack += ackOffset
+			shifted = shifted || seqOffset != 0 || ackOffset != 0
+		}
+	}
+
+	b, err := rewritePacketPayload(packet, mutate, rewriteTCP)
+	if err != nil {
+		logger.Debugf("Cannot mutate packet [%d], not modify. (%s)\n", r.index, err)
+		return emit(r)
+	}
+	// 未修改时原样输出, 不修正原本错误的长度和校验和
+	if !mutated && !shifted {
+		return emit(r)
+	}
+	r.setData(b)
+	if mutated {
+		s.mutated++
+	}
+	return emit(r)
+}
+
+func (s *mutatePayloadStage) flush(emit emitFunc) error {
+	if s.mutated == 0 {
+		return fmt.Errorf("can not mutate any packet")
+	}
+	return nil
+}
+
+// shufflePacketStage 保留前 n 个和后 m 个 packet, 打乱中间部分的顺序
+// 如果 小于等于 n+m+1 个 packet, 不进行操作
+// 前 n 个 packet 直接输出, 之后的 packet 写入 dir 下的临时文件, 内存中只保留每个 packet 在文件中的位置,
+// flush 时按照打乱后的顺序读回并输出, 因此内存占用与 packet 的内容无关
+type shufflePacketStage struct {
+	n, m    int
+	rand    *rand.Rand
+	dir     string
+	emitted int
+
+	file    *os.File
+	writer  *bufio.Writer
+	offsets []int64
+	size    int64
+}
+
+// shuffleRecordHeader 是临时文件中每个 packet 的头部长度:
+// 时间戳 8, index 8, length 4, interface 4, link type 2, flags 1, options 长度 4, data 长度 4
+const shuffleRecordHeader = 35
+
+const (
+	shuffleFromClient = 1 << iota
+	shuffleLinkType   // CaptureInfo.AncillaryData 中带有 link type
+	shuffleOptions    // CaptureInfo.AncillaryData 中带有 pcapng 的 packet options
+)
+
+func (s *shufflePacketStage) process(r *packetRecord, emit emitFunc) error {
+	if s.emitted < s.n {
+		s.emitted++
+		return emit(r)
+	}
+	if s.file == nil {
+		file, err := ioutil.TempFile(s.dir, "shuffle-*.tmp")
+		if err != nil {
+			return fmt.Errorf("cannot create temporary file for shuffle packet: %w", err)
+		}
+		s.file = file
+		s.writer = bufio.NewWriter(file)
+	}
+
+	var flags byte
+	var options pcapngPacketOptions
+	if r.fromClient {
+		flags |= shuffleFromClient
+	}
+	for i, v := range r.ci.AncillaryData {
+		if _, ok := v.(layers.LinkType); ok && i == 0 {
+			flags |= shuffleLinkType
+		}
+		if o, ok := v.(pcapngPacketOptions); ok {
+			flags |= shuffleOptions
+			options = o
+		}
+	}
+
+	header := make([]byte, shuffleRecordHeader)
+	binary.LittleEndian.PutUint64(header[0:8], uint64(r.ci.Timestamp.UnixNano()))
+	binary.LittleEndian.PutUint64(header[8:16], uint64(r.index))
+	binary.LittleEndian.PutUint32(header[16:20], uint32(r.ci.Length-r.ci.CaptureLength+len(r.data)))
+	binary.LittleEndian.PutUint32(header[20:24], uint32(r.ci.InterfaceIndex))
+	binary.LittleEndian.PutUint16(header[24:26], uint16(r.linkType))
+	header[26] = flags
+	binary.LittleEndian.PutUint32(header[27:31], uint32(len(options)))
+	binary.LittleEndian.PutUint32(header[31:35], uint32(len(r.data)))
+	for _, b := range [][]byte{header, options, r.data} {
+		if _, err := s.writer.Write(b); err != nil {
+			return fmt.Errorf("cannot write packet [%d] to temporary file: %w", r.index, err)
+		}
+	}
+	s.offsets = append(s.offsets, s.size)
+	s.size += int64(shuffleRecordHeader + len(options) + len(r.data))
+	return nil
+}
+
+// readRecord 读回位于 offset 的 packet
+func (s *shufflePacketStage) readRecord(offset int64) (*packetRecord, error) {
+	header := make([]byte, shuffleRecordHeader)
+	if _, err := s.file.ReadAt(header, offset); err != nil {
+		return nil, fmt.Errorf("cannot read temporary file of shuffle packet: %w", err)
+	}
+	optionsLength := binary.LittleEndian.Uint32(header[27:31])
+	dataLength := binary.LittleEndian.Uint32(header[31:35])
+	body := make([]byte, optionsLength+dataLength)
+	if _, err := s.file.ReadAt(body, offset+shuffleRecordHeader); err != nil {
+		return nil, fmt.Errorf("cannot read temporary file of shuffle packet: %w", err)
+	}
+
+	flags := header[26]
+	r := &packetRecord{
+		ci: gopacket.CaptureInfo{
+			Timestamp:      time.Unix(0, int64(binary.LittleEndian.Uint64(header[0:8]))),
+			CaptureLength:  int(dataLength),
+			Length:         int(binary.LittleEndian.Uint32(header[16:20])),
+			InterfaceIndex: int(int32(binary.LittleEndian.Uint32(header[20:24]))),
+		},
+		data:       body[optionsLength:],
+		index:      int(binary.LittleEndian.Uint64(header[8:16])),
+		fromClient: flags&shuffleFromClient != 0,
+		linkType:   layers.LinkType(binary.LittleEndian.Uint16(header[24:26])),
+	}
+	if flags&shuffleLinkType != 0 {
+		r.ci.AncillaryData = append(r.ci.AncillaryData, r.linkType)
+	}
+	if flags&shuffleOptions != 0 {
+		r.ci.AncillaryData = append(r.ci.AncillaryData, pcapngPacketOptions(body[:optionsLength]))
+	}
+	return r, nil
+}
+
+func (s *shufflePacketStage) flush(emit emitFunc) error {
+	if s.file == nil {
+		return nil
+	}
+	defer s.Close()
+	if err := s.writer.Flush(); err != nil {
+		return fmt.Errorf("cannot write temporary file of shuffle packet: %w", err)
+	}
+
+	if len(s.offsets) > s.m+1 {
+		middle := s.offsets[:len(s.offsets)-s.m]
+		s.rand.Shuffle(len(middle), func(i, j int) {
+			middle[i], middle[j] = middle[j], middle[i]
+		})
+	}
+	for _, offset := range s.offsets {
+		r, err := s.readRecord(offset)
+		if err != nil {
+			return err
+		}
+		if err = emit(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close 删除临时文件, 流水线出错提前结束时也会调用
+func (s *shufflePacketStage) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	err := os.Remove(s.file.Name())
+	s.file, s.writer, s.offsets = nil, nil, nil
+	return err
+}
+
+// adjustTimeStage 将 packet 的时间戳平移 offset
+type adjustTimeStage struct {
+	offset time.Duration
+}
+
+func (s *adjustTimeStage) process(r *packetRecord, emit emitFunc) error {
+	r.ci.Timestamp = r.ci.Timestamp.Add(s.offset)
+	return emit(r)
+}
+
+func (s *adjustTimeStage) flush(emit emitFunc) error {
+	return nil
+}
+
+// portStage 改写 TCP / UDP 端口
+type portStage struct {
+	remapper *portRemapper
+}
+
+func (s *portStage) process(r *packetRecord, emit emitFunc) error {
+	if r.linkType == layers.LinkTypeEthernet && s.remapper.remap(r.data, r.fromClient) {
+		r.packet = nil
+	}
+	return emit(r)
+}
+
+func (s *portStage) flush(emit emitFunc) error {
+	return nil
+}
+
+// ipStage 改写 IP 地址, 优先使用 ipMap 中的规则, 未匹配的地址使用 anonymizer 匿名化或者改写到 endpoints 中,
+// endpoints 的方向由源文件中的原始地址决定, 都为 nil 时保持不变; 广播/组播等地址总是保持不变
+// amplifier 不为 nil 时, 改写后的客户端地址再按照放大的 variant 改写
+type ipStage struct {
+	ipMap      *ipMapper
+	anonymizer *cryptoPAn
+	endpoints  *EndPoints
+	amplifier  *hostAmplifier
+}
+
+func (s *ipStage) process(r *packetRecord, emit emitFunc) error {
+	changed := rewriteIPAddresses(r.data, func(ip net.IP, isSrc bool) net.IP {
+		if ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+			return ip
+		}
+		toClient := isSrc == r.fromClient
+		newIP := s.rewrite(ip, toClient)
+		if s.amplifier != nil && toClient {
+			newIP = s.amplifier.amplifyHost(newIP)
+		}
+		return newIP
+	})
+	if changed {
+		r.packet = nil
+	}
+	return emit(r)
+}
+
+// rewrite 按照 ip_map, 匿名化或客户端/服务端网段改写地址, 都未配置时保持不变
+func (s *ipStage) rewrite(ip net.IP, toClient bool) net.IP {
+	if mapped, ok := s.ipMap.mapIP(ip); ok {
+		return mapped
+	} else if s.anonymizer != nil {
+		return s.anonymizer.anonymize(ip)
+	} else if s.endpoints != nil {
+		return s.endpoints.rewrite(ip, toClient)
+	}
+	return ip
+}
+
+func (s *ipStage) flush(emit emitFunc) error {
+	return nil
+}
+
+// macStage 按照 IP 地址改写 MAC 地址, 位于 ipStage 之后, 使用改写后的 IP
+type macStage struct {
+	rewriter *macRewriter
+}
+
+func (s *macStage) process(r *packetRecord, emit emitFunc) error {
+	if r.linkType != layers.LinkTypeEthernet {
+		return emit(r)
+	}
+	if err := s.rewriter.rewrite(r.data); err != nil {
+		logger.Debugf("Cannot rewrite mac of packet [%d], not modify. (%s)\n", r.index, err)
+	} else {
+		r.packet = nil
+	}
+	return emit(r)
+}
+
+func (s *macStage) flush(emit emitFunc) error {
+	return nil
+}
+
+// malformStage 以 rate 的概率损坏 packet 的首部, 被损坏的 packet 记录到 recordPath 中
+// 损坏后的首部无法被正常解析, 需要放在其他解析 IP 首部的步骤之后
+type malformStage struct {
+	malformer  *headerMalformer
+	rate       float64
+	recordPath string
+
+	frame   int // 已经输出的 packet 数量
+	skipped int // 不是以太网帧而跳过的 packet 数量
+	records []malformRecord
+}
+
+func (s *malformStage) process(r *packetRecord, emit emitFunc) error {
+	s.frame++
+	if r.linkType != layers.LinkTypeEthernet {
+		s.skipped++
+		return emit(r)
+	}
+	if s.malformer.rand.Float64() >= s.rate {
+		return emit(r)
+	}
+
+	data := append([]byte(nil), r.data...)
+	if kind, detail, ok := s.malformer.malform(data); ok {
+		r.setData(data)
+		s.records = append(s.records, malformRecord{Frame: s.frame, Index: r.index, Kind: kind, Detail: detail})
+	}
+	return emit(r)
+}
+
+func (s *malformStage) flush(emit emitFunc) error {
+	if s.skipped > 0 {
+		logger.Warnf("%d of %d packets are not ethernet frames, not malformed\n", s.skipped, s.frame)
+	}
+	logger.Debugf("malformed %d of %d packets, recorded in %s\n", len(s.records), s.frame, s.recordPath)
+	return saveMalformRecords(s.recordPath, s.records)
+}
+
+// splitRecord 将 r 替换为多个 frame 依次输出, 时间戳和其他信息保持不变
+func splitRecord(r *packetRecord, frames [][]byte, emit emitFunc) error {
+	for _, frame := range frames {
+		split := *r
+		split.setData(frame)
+		if err := emit(&split); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resegmentStage 将 TCP payload 重新切分为多个 segment
+type resegmentStage struct {
+	resegmenter *tcpResegmenter
+}
+
+func (s *resegmentStage) process(r *packetRecord, emit emitFunc) error {
+	if r.linkType != layers.LinkTypeEthernet || r.ci.CaptureLength < r.ci.Length || isFragment(r.decoded()) {
+		return emit(r)
+	}
+	frames, err := s.resegmenter.resegment(r.data)
+	if err != nil {
+		logger.Debugf("Cannot resegment packet [%d], not modify. (%s)\n", r.index, err)
+	}
+	if len(frames) == 0 {
+		return emit(r)
+	}
+	return splitRecord(r, frames, emit)
+}
+
+func (s *resegmentStage) flush(emit emitFunc) error {
+	return nil
+}
+
+// fragmentStage 将超过 MTU 的 IP packet 分片, 位于 resegmentStage 之后
+type fragmentStage struct {
+	fragmenter *ipFragmenter
+}
+
+func (s *fragmentStage) process(r *packetRecord, emit emitFunc) error {
+	if r.linkType != layers.LinkTypeEthernet || r.ci.CaptureLength < r.ci.Length {
+		return emit(r)
+	}
+	frames, err := s.fragmenter.fragment(r.data)
+	if err != nil {
+		logger.Debugf("Cannot fragment packet [%d], not modify. (%s)\n", r.index, err)
+	}
+	if len(frames) == 0 {
+		return emit(r)
+	}
+	return splitRecord(r, frames, emit)
+}
+
+func (s *fragmentStage) flush(emit emitFunc) error {
+	return nil
+}
+
+// heldRecord 是因为乱序而推迟输出的 packet, 之后再经过 remaining 个 packet 时输出
+type heldRecord struct {
+	record    *packetRecord
+	flow      string
+	remaining int
+	idle      int // 之后连续经过的其它流的 packet 数量
+}
+
+// impairStage 模拟网络损伤: 按照概率丢弃和重复 packet, 为时间戳增加抖动, 以及局部乱序
+// 乱序的 packet 推迟到同一个流 (或者任意) 之后的 1 到 reorderDistance 个 packet 后输出,
+// 同一个流连续 reorderFlowIdlePackets 个 packet 没有出现时也立即输出
+// 输出的时间戳不早于之前输出的 packet, 使得时间顺序与文件中的顺序一致
+type impairStage struct {
+	dropRate        float64
+	duplicateRate   float64
+	jitter          time.Duration
+	reorderRate     float64
+	reorderDistance int
+	reorderScope    string
+	rand            *rand.Rand
+	name            string // 用于输出统计信息
+
+	held    []*heldRecord
+	last    time.Time // 已经输出的 packet 中最晚的时间戳
+	summary impairSummary
+}
+
+func (s *impairStage) process(r *packetRecord, emit emitFunc) error {
+	s.summary.total++
+	if s.dropRate > 0 && s.rand.Float64() < s.dropRate {
+		s.summary.dropped++
+		return nil
+	}
+
+	records := []*packetRecord{r}
+	if s.duplicateRate > 0 && s.rand.Float64() < s.duplicateRate {
+		duplicate := *r
+		duplicate.data = append([]byte(nil), r.data...)
+		duplicate.packet = nil
+		records = append(records, &duplicate)
+		s.summary.duplicated++
+	}
+
+	for _, record := range records {
+		if s.jitter > 0 {
+			record.ci.Timestamp = record.ci.Timestamp.Add(time.Duration(s.rand.Int63n(int64(s.jitter) + 1)))
+			s.summary.jittered++
+		}
+		if err := s.reorder(record, emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reorder 以 reorderRate 的概率推迟输出 r, 否则立即输出, 并输出经过了足够多 packet 的推迟的 packet
+func (s *impairStage) reorder(r *packetRecord, emit emitFunc) error {
+	flow := ""
+	if s.reorderRate > 0 && s.reorderScope == reorderScopeFlow {
+		flow = recordFlowKey(r)
+	}
+
+	// 所在的流已经结束的 packet 不再等待, 在 r 之前输出
+	if flow != "" && len(s.held) > 0 {
+		for _, h := range s.held {
+			if h.flow == flow {
+				h.idle = 0
+			} else {
+				h.idle++
+			}
+		}
+		if err := s.release(emit, func(h *heldRecord) bool { return h.idle >= reorderFlowIdlePackets }); err != nil {
+			return err
+		}
+	}
+
+	if s.reorderRate > 0 && s.rand.Float64() < s.reorderRate {
+		s.held = append(s.held, &heldRecord{record: r, flow: flow, remaining: 1 + s.rand.Intn(s.reorderDistance)})
+		s.summary.reordered++
+		return nil
+	}
+
+	if err := s.emit(r, emit); err != nil {
+		return err
+	}
+
+	for _, h := range s.held {
+		if h.flow == flow {
+			h.remaining--
+		}
+	}
+	return s.release(emit, func(h *heldRecord) bool { return h.remaining <= 0 })
+}
+
+// release 按照推迟的顺序输出满足 ready 的 packet
+func (s *impairStage) release(emit emitFunc, ready func(h *heldRecord) bool) error {
+	held := s.held[:0]
+	var records []*packetRecord
+	for _, h := range s.held {
+		if ready(h) {
+			records = append(records, h.record)
+		} else {
+			held = append(held, h)
+		}
+	}
+	s.held = held
+	for _, record := range records {
+		if err := s.emit(record, emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *impairStage) emit(r *packetRecord, emit emitFunc) error {
+	if r.ci.Timestamp.Before(s.last) {
+		r.ci.Timestamp = s.last
+	}
+	s.last = r.ci.Timestamp
+	return emit(r)
+}
+
+func (s *impairStage) flush(emit emitFunc) error {
+	for _, h := range s.held {
+		if err := s.emit(h.record, emit); err != nil {
+			return err
+		}
+	}
+	s.held = nil
+	logger.Infof("%s impaired %d packets: dropped %d, duplicated %d, jittered %d, reordered %d\n", s.name,
+		s.summary.total, s.summary.dropped, s.summary.duplicated, s.summary.jittered, s.summary.reordered)
+	return nil
+}
+
+// tagStage 弹出或压入 VLAN 标签和 MPLS label
+// 弹出放在流水线的最前面, 压入放在最后面, 中间的步骤只需要处理 VLAN 标签
+type tagStage struct {
+	rewriter *tagRewriter
+}
+
+func (s *tagStage) process(r *packetRecord, emit emitFunc) error {
+	if r.linkType != layers.LinkTypeEthernet {
+		return emit(r)
+	}
+	b, err := s.rewriter.rewrite(r.decoded())
+	if err != nil {
+		logger.Debugf("Cannot rewrite tags of packet [%d], not modify. (%s)\n", r.index, err)
+	} else {
+		r.setData(b)
+	}
+	return emit(r)
+}
+
+func (s *tagStage) flush(emit emitFunc) error {
+	return nil
+}
+
+// decapStage 还原隧道 packet, 放在弹出标签之后, 使后续的步骤处理内层数据
+type decapStage struct {
+	decapsulator *tunnelDecapsulator
+}
+
+func (s *decapStage) process(r *packetRecord, emit emitFunc) error {
+	if r.linkType != layers.LinkTypeEthernet {
+		return emit(r)
+	}
+	b, err := s.decapsulator.decapsulate(r.data)
+	if err != nil {
+		logger.Debugf("Cannot decapsulate packet [%d], not modify. (%s)\n", r.index, err)
+	} else if b != nil {
+		r.setData(b)
+	}
+	return emit(r)
+}
+
+func (s *decapStage) flush(emit emitFunc) error {
+	return nil
+}
+
+// encapStage 将 packet 封装到隧道中, 放在其他修改内层数据的步骤之后, 压入标签之前
+type encapStage struct {
+	encapsulator *tunnelEncapsulator
+}
+
+func (s *encapStage) process(r *packetRecord, emit emitFunc) error {
+	if r.linkType != layers.LinkTypeEthernet {
+		return emit(r)
+	}
+	b, err := s.encapsulator.encapsulate(r.data, r.fromClient)
+	if err != nil {
+		logger.Debugf("Cannot encapsulate packet [%d], not modify. (%s)\n", r.index, err)
+	} else {
+		r.setData(b)
+	}
+	return emit(r)
+}
+
+func (s *encapStage) flush(emit emitFunc) error {
+	return nil
+}
+
+// retimeStage 以第一个 packet 的时间为起点重新计算时间戳, 放在流水线的最后, 使得 bps 按照最终的长度计算
+// scale 大于 0 时将与第一个 packet 的时间间隔乘以 scale, 否则按照 pps 或 bps 匀速发送, 时间戳按照文件中的顺序递增,
+// 两种方式都不改变 packet 的顺序, 因此每个流中的顺序保持不变
+type retimeStage struct {
+	scale float64
+	pps   float64
+	bps   float64
+
+	start time.Time
+	count int64 // 已经处理的 packet 数量
+	bits  int64 // 已经处理的 packet 的总位数
+}
+
+func (s *retimeStage) process(r *packetRecord, emit emitFunc) error {
+	if s.count == 0 {
+		s.start = r.ci.Timestamp
+	}
+
+	switch {
+	case s.scale > 0:
+		r.ci.Timestamp = s.start.Add(time.Duration(float64(r.ci.Timestamp.Sub(s.start)) * s.scale))
+	case s.pps > 0:
+		r.ci.Timestamp = s.start.Add(time.Duration(float64(s.count) / s.pps * float64(time.Second)))
+	case s.bps > 0:
+		r.ci.Timestamp = s.start.Add(time.Duration(float64(s.bits) / s.bps * float64(time.Second)))
+	}
+
+	s.count++
+	// 与写出时一致, 原始长度随数据长度的变化而变化
+	s.bits += int64(r.ci.Length+len(r.data)-r.ci.CaptureLength) * 8
+	return emit(r)
+}
+
+func (s *retimeStage) flush(emit emitFunc) error {
+	return nil
+}
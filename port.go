@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// 随机改写的客户端端口使用 IANA 规定的临时端口范围
+const (
+	ephemeralPortMin = 49152
+	ephemeralPortMax = 65535
+)
+
+type portKey struct {
+	protocol layers.IPProtocol
+	port     uint16
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, errors.New(fmt.Sprintf("invalid port: %s", s))
+	}
+	return uint16(port), nil
+}
+
+// parsePortMap 解析端口映射规则, key 为 80 / tcp/80 / udp/53, 不指定协议时同时作用于 TCP 和 UDP
+func parsePortMap(rules map[string]string) (map[portKey]uint16, error) {
+	portMap := make(map[portKey]uint16)
+	for from, to := range rules {
+		protocols := []layers.IPProtocol{layers.IPProtocolTCP, layers.IPProtocolUDP}
+		if parts := strings.SplitN(from, "/", 2); len(parts) == 2 {
+			switch strings.ToLower(parts[0]) {
+			case "tcp":
+				protocols = protocols[:1]
+			case "udp":
+				protocols = protocols[1:]
+			default:
+				return nil, errors.New(fmt.Sprintf("invalid protocol in %s, must be tcp or udp", from))
+			}
+			from = parts[1]
+		}
+
+		fromPort, err := parsePort(from)
+		if err != nil {
+			return nil, err
+		}
+		toPort, err := parsePort(to)
+		if err != nil {
+			return nil, err
+		}
+		for _, protocol := range protocols {
+			portMap[portKey{protocol: protocol, port: fromPort}] = toPort
+		}
+	}
+	return portMap, nil
+}
+
+// portFlowKey 是不区分方向的流标识, a 为地址和端口较小的一端
+type portFlowKey struct {
+	protocol layers.IPProtocol
+	a, b     string
+	aPort    uint16
+	bPort    uint16
+}
+
+type portFlow struct {
+	clientIsA  bool
+	clientPort uint16 // 改写后的客户端端口
+}
+
+// portRemapper 改写 TCP / UDP 端口并增量修正校验和
+// 映射规则同时作用于两个方向; 随机改写客户端端口时, 同一个流中的客户端端口总是改写为同一个端口, 映射规则优先
+type portRemapper struct {
+	portMap       map[portKey]uint16
+	randomClient  bool
+	rand          *rand.Rand
+	flows         map[portFlowKey]*portFlow
+	assignedPorts map[string]bool // 客户端地址和改写后的端口, 避免不同的流被改写为同一个端口
+}
+
+func newPortRemapper(portMap map[portKey]uint16, randomClient bool, r *rand.Rand) *portRemapper {
+	return &portRemapper{
+		portMap:       portMap,
+		randomClient:  randomClient,
+		rand:          r,
+		flows:         make(map[portFlowKey]*portFlow),
+		assignedPorts: make(map[string]bool),
+	}
+}
+
+// flow 返回 packet 所属的流, 首次出现时确定客户端: TCP 以 SYN 判断, 否则以源文件中的原始地址判断
+func (m *portRemapper) flow(view *ipPacketView, srcPort, dstPort uint16, flags byte, fromClient bool) (*portFlow, bool) {
+	key := portFlowKey{protocol: view.protocol, a: string(view.src), aPort: srcPort, b: string(view.dst), bPort: dstPort}
+	srcIsA := true
+	if key.a > key.b || (key.a == key.b && key.aPort > key.bPort) {
+		key.a, key.b, key.aPort, key.bPort = key.b, key.a, key.bPort, key.aPort
+		srcIsA = false
+	}
+	if flow, ok := m.flows[key]; ok {
+		return flow, srcIsA
+	}
+
+	srcIsClient := fromClient
+	if view.protocol == layers.IPProtocolTCP && flags&0x02 != 0 { // SYN
+		srcIsClient = flags&0x10 == 0 // SYN-ACK 由服务端发出
+	}
+	flow := &portFlow{clientIsA: srcIsClient == srcIsA}
+
+	clientIP, clientPort := key.b, key.bPort
+	if flow.clientIsA {
+		clientIP, clientPort = key.a, key.aPort
+	}
+	flow.clientPort = m.mapPort(view.protocol, clientPort)
+	if _, mapped := m.portMap[portKey{protocol: view.protocol, port: clientPort}]; !mapped {
+		for {
+			port := uint16(ephemeralPortMin + m.rand.Intn(ephemeralPortMax-ephemeralPortMin+1))
+			assigned := clientIP + strconv.Itoa(int(port))
+			if !m.assignedPorts[assigned] {
+				m.assignedPorts[assigned] = true
+				flow.clientPort = port
+				break
+			}
+		}
+	}
+
+	m.flows[key] = flow
+	return flow, srcIsA
+}
+
+func (m *portRemapper) mapPort(protocol layers.IPProtocol, port uint16) uint16 {
+	if mapped, ok := m.portMap[portKey{protocol: protocol, port: port}]; ok {
+		return mapped
+	}
+	return port
+}
+
+// remap 原地改写以太网帧中的端口, 返回是否有修改
+func (m *portRemapper) remap(data []byte, fromClient bool) bool {
+	view, ok := parseIPPacketView(data)
+	if !ok || view.l4Offset < 0 || (view.protocol != layers.IPProtocolTCP && view.protocol != layers.IPProtocolUDP) {
+		return false
+	}
+	l4 := view.l4Offset
+	if l4+4 > len(data) || (view.protocol == layers.IPProtocolTCP && l4+14 > len(data)) {
+		return false
+	}
+
+	srcPort := binary.BigEndian.Uint16(data[l4:])
+	dstPort := binary.BigEndian.Uint16(data[l4+2:])
+	newSrc, newDst := m.mapPort(view.protocol, srcPort), m.mapPort(view.protocol, dstPort)
+
+	if m.randomClient {
+		var flags byte
+		if view.protocol == layers.IPProtocolTCP {
+			flags = data[l4+13]
+		}
+		flow, srcIsA := m.flow(view, srcPort, dstPort, flags, fromClient)
+		if flow.clientIsA == srcIsA {
+			newSrc = flow.clientPort
+		} else {
+			newDst = flow.clientPort
+		}
+	}
+
+	if newSrc == srcPort && newDst == dstPort {
+		return false
+	}
+
+	old := append([]byte(nil), data[l4:l4+4]...)
+	binary.BigEndian.PutUint16(data[l4:], newSrc)
+	binary.BigEndian.PutUint16(data[l4+2:], newDst)
+
+	// UDP 校验和为 0 表示未计算
+	if pos := view.l4ChecksumOffset(len(data)); pos >= 0 {
+		if view.protocol == layers.IPProtocolUDP && binary.BigEndian.Uint16(data[pos:]) == 0 {
+			return true
+		}
+		updateChecksum(data, pos, old, data[l4:l4+4])
+		if view.protocol == layers.IPProtocolUDP && binary.BigEndian.Uint16(data[pos:]) == 0 {
+			binary.BigEndian.PutUint16(data[pos:], 0xffff)
+		}
+	}
+	return true
+}
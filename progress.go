@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	progressMinSize  int64 = 256 * 1024 * 1024 // 小于该大小的文件不报告进度
+	progressInterval       = 5 * time.Second
+)
+
+// progressReader 统计已读取的字节数, 处理大文件时定期输出进度
+type progressReader struct {
+	r     io.Reader
+	name  string
+	total int64
+	read  int64
+
+	start time.Time
+	last  time.Time
+}
+
+// newProgressReader 包装 file, 文件较小或无法获取大小时直接返回 file 本身
+func newProgressReader(file *os.File) io.Reader {
+	s, err := file.Stat()
+	if err != nil || s.Size() < progressMinSize {
+		return file
+	}
+
+	now := time.Now()
+	return &progressReader{
+		r:     file,
+		name:  file.Name(),
+		total: s.Size(),
+		start: now,
+		last:  now,
+	}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		logger.Infoln(p)
+	}
+	return n, err
+}
+
+func (p *progressReader) String() string {
+	return fmt.Sprintf("processing %s: %.1f%% (%d/%d MB) in %s", p.name,
+		float64(p.read)*100/float64(p.total), p.read>>20, p.total>>20, time.Now().Sub(p.start).Round(time.Second))
+}
@@ -39,6 +39,7 @@ func run() {
 		logger.Errorln("no job selected !!!")
 		return
 	}
+	logger.Infoln(fmt.Sprintf("using seed %d, run with --seed %d to reproduce", config.Seed, config.Seed))
 
 	/*
 		并发加载 finder 的 pcap 列表, 然后决定是否仅展示 Pcap 列表
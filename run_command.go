@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -9,12 +10,15 @@ import (
 )
 
 type RealCommand struct {
-	round   int
-	total   int
-	command *Command
-	pcap    *Pcap
-	realJob *RealJob
-	g       *sync.WaitGroup
+	round        int
+	total        int
+	command      *Command
+	pcap         *Pcap
+	realJob      *RealJob
+	merger       *pcapMerger // 仅 merge 类型的命令使用
+	index        int         // pcap 在 finder 中的序号
+	amplifyIndex int         // 放大时 variant 的序号
+	g            *sync.WaitGroup
 }
 
 func (r *RealCommand) String() string {
@@ -25,6 +29,21 @@ func (r *RealCommand) String() string {
 	}
 }
 
+// seed 返回该次执行生成 pcap 所用的种子, 由 modifier 的种子 (未指定时使用全局种子) 和 (round, job, command, pcap) 共同决定,
+// 使用同样的种子再次运行即可重新生成同一个 variant; 放大时各个 variant 的种子再由该种子和 variant 的序号派生
+// 指定了 --variant-seed 时直接使用该种子, 以便单独重新生成之前某一个 variant
+func (r *RealCommand) seed() int64 {
+	if config.VariantSeed != 0 {
+		return config.VariantSeed
+	}
+	base := config.Seed
+	if modifier := r.pcap.file.finder.modifier; modifier.Seed != 0 {
+		base = modifier.Seed
+	}
+	return mixSeed(base, strconv.Itoa(r.realJob.round), r.realJob.job.Id, strconv.Itoa(r.command.Index),
+		r.pcap.file.finder.Id, r.pcap.file.relativePath)
+}
+
 func (r *RealCommand) run() {
 	logger.Infoln(fmt.Sprintf("%s executing", r))
 	start := time.Now()
@@ -18,6 +18,16 @@ func loadPcaps() {
 
 	start := time.Now()
 
+	if config.IndexFile != "" {
+		idx, err := loadPcapIndex(config.IndexFile)
+		if err != nil {
+			// 索引仅用于加速, 不可用时不影响正常使用
+			logger.Warnln(fmt.Sprintf("ignore pcap index: %s", err))
+		} else {
+			pcapIndex = idx
+		}
+	}
+
 	for _, finder := range finders {
 		if !finder.Used {
 			// 忽略未使用的 finder
@@ -70,6 +80,10 @@ func loadPcaps() {
 		}
 	}
 
+	if err := pcapIndex.save(); err != nil {
+		logger.Warnln(fmt.Sprintf("%s save failed: %s", pcapIndex, err))
+	}
+
 	end := time.Now()
 	duration := end.Sub(start)
 	logger.Infoln(fmt.Sprintf("load pcaps totally use: %s", duration))
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/panjf2000/ants/v2"
+	logger "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"go.uber.org/atomic"
+)
+
+var (
+	defaultIndexFile = "/data/.prsdata/index.json"
+
+	indexCmd = &cobra.Command{
+		Use:   "index",
+		Short: "管理 pcap 元数据索引",
+	}
+
+	indexRebuildCmd = &cobra.Command{
+		Use:   "rebuild",
+		Short: "重新解析指定目录下的全部 pcap 并更新索引",
+		Run: func(cmd *cobra.Command, args []string) {
+			idx := openIndexFromFlags(cmd)
+			directories, _ := cmd.Flags().GetStringSlice("directory")
+			rebuildPcapIndex(idx, directories)
+			saveIndex(idx)
+		},
+	}
+
+	indexPruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "删除索引中已不存在或已变化的 pcap",
+		Run: func(cmd *cobra.Command, args []string) {
+			idx := openIndexFromFlags(cmd)
+			count := idx.prune()
+			logger.Infoln(fmt.Sprintf("%s pruned %d entries, %d left", idx, count, len(idx.Entries)))
+			saveIndex(idx)
+		},
+	}
+)
+
+func init() {
+	indexCmd.PersistentFlags().String("index-file", defaultIndexFile, "pcap 元数据索引文件路径")
+	indexCmd.PersistentFlags().Bool("debug", false, "debug mode")
+	indexRebuildCmd.Flags().StringSliceP("directory", "d", []string{"/data/.prsdata/pcaps/"}, "pcap search directory, 可多次使用")
+
+	indexCmd.AddCommand(indexRebuildCmd)
+	indexCmd.AddCommand(indexPruneCmd)
+}
+
+func openIndexFromFlags(cmd *cobra.Command) *PcapIndex {
+	if debug, _ := cmd.Flags().GetBool("debug"); debug {
+		logger.SetLevel(logger.DebugLevel)
+	}
+
+	indexFile, _ := cmd.Flags().GetString("index-file")
+	if indexFile == "" {
+		logger.Errorln("index file path empty")
+		exit(1)
+	}
+	indexFile, _ = homedir.Expand(indexFile)
+	indexFile, _ = filepath.Abs(indexFile)
+
+	idx, err := loadPcapIndex(indexFile)
+	if err != nil {
+		logger.Errorln(err)
+		exit(1)
+	}
+	return idx
+}
+
+func saveIndex(idx *PcapIndex) {
+	if err := idx.save(); err != nil {
+		logger.Errorln(fmt.Sprintf("%s save failed: %s", idx, err))
+		exit(1)
+	}
+}
+
+// rebuildPcapIndex 丢弃目录下已有的索引, 重新解析目录下的全部 pcap
+func rebuildPcapIndex(idx *PcapIndex, directories []string) {
+	pool, _ := ants.NewPool(20) // fixed pool
+	defer pool.Release()
+
+	start := time.Now()
+
+	for _, directory := range directories {
+		directory, _ = homedir.Expand(directory)
+		absDirectory, _ := filepath.Abs(directory)
+
+		s, err := os.Stat(absDirectory)
+		if err != nil || !s.IsDir() {
+			logger.Errorln(fmt.Sprintf("directory \"%s\" does not exists!", directory))
+			continue
+		}
+
+		idx.lock.Lock()
+		for path := range idx.Entries {
+			if strings.HasPrefix(path, absDirectory+string(filepath.Separator)) {
+				delete(idx.Entries, path)
+				idx.dirty = true
+			}
+		}
+		idx.lock.Unlock()
+
+		logger.Infoln(fmt.Sprintf("%s indexing pcaps under %s", idx, absDirectory))
+
+		wg := sync.WaitGroup{}
+		indexed := atomic.NewInt32(0)
+		finder := &Finder{absDirectory: absDirectory}
+
+		_ = filepath.Walk(absDirectory, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+
+			file := &File{path: path, finder: finder, info: info}
+			file.parse()
+			if file.isValidPcapSuffix() != nil {
+				return nil
+			}
+
+			wg.Add(1)
+			_ = pool.Submit(func() {
+				defer wg.Done()
+				pcapInfo, err := readPcapInfo(path)
+				if err != nil {
+					logger.Warnln(fmt.Sprintf("%s can not parse %s: %s", idx, path, err))
+					return
+				}
+				idx.store(path, info, pcapInfo)
+				indexed.Inc()
+			})
+			return nil
+		})
+		wg.Wait()
+
+		logger.Infoln(fmt.Sprintf("%s indexed %d pcaps under %s", idx, indexed.Load(), absDirectory))
+	}
+
+	logger.Infoln(fmt.Sprintf("rebuild index totally use: %s", time.Now().Sub(start)))
+}
@@ -25,8 +25,8 @@ func runCommands(realJob *RealJob) {
 
 		if command.Type == "shell" {
 			totalCount = 1
-		} else { // pcap
-			totalCount = len(command.finder.pcaps)
+		} else { // pcap or merge
+			totalCount = len(command.finder.pcaps) * command.Amplify
 		}
 
 		round := 0
@@ -43,25 +43,38 @@ func runCommands(realJob *RealJob) {
 				g.Add(1)
 				_ = realJob.pool.Invoke(realCommand)
 			} else {
-				// pcap
-				for _, pcap := range command.finder.pcaps {
+				// pcap or merge
+				var merger *pcapMerger
+				if command.Type == "merge" {
+					merger = newPcapMerger(command, len(command.finder.pcaps))
+				}
+				for index, pcap := range command.finder.pcaps {
+					for amplifyIndex := 0; amplifyIndex < command.Amplify; amplifyIndex++ {
 
-					if !RUNNING {
-						return
-					}
+						if !RUNNING {
+							return
+						}
 
-					round++
+						round++
 
-					realCommand := &RealCommand{
-						round:   round,
-						total:   totalCount,
-						command: command,
-						pcap:    pcap,
-						realJob: realJob,
-						g:       &g,
+						realCommand := &RealCommand{
+							round:        round,
+							total:        totalCount,
+							command:      command,
+							pcap:         pcap,
+							realJob:      realJob,
+							merger:       merger,
+							index:        index,
+							amplifyIndex: amplifyIndex,
+							g:            &g,
+						}
+						g.Add(1)
+						_ = realJob.pool.Invoke(realCommand)
 					}
-					g.Add(1)
-					_ = realJob.pool.Invoke(realCommand)
+				}
+				if merger != nil {
+					g.Wait()
+					merger.run(realJob, command)
 				}
 			}
 		}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// newBaseSeed 在未指定 --seed 时生成本次运行的种子, 打印到日志中以便复现
+func newBaseSeed() int64 {
+	for {
+		if seed := time.Now().UnixNano(); seed != 0 {
+			return seed
+		}
+	}
+}
+
+// mixSeed 将 base 与各个维度混合为新的种子, 任一维度变化都会得到完全不同的种子
+func mixSeed(base int64, parts ...string) int64 {
+	h := fnv.New64a()
+	_ = binary.Write(h, binary.BigEndian, base)
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0}) // 分隔符, 避免 ("ab", "c") 与 ("a", "bc") 冲突
+	}
+	return int64(h.Sum64())
+}
+
+// subRand 为同一个 variant 的不同用途派生独立的随机数序列,
+// 新增或关闭某个修改步骤不会影响其他步骤的随机结果
+func subRand(seed int64, purpose string) *rand.Rand {
+	return rand.New(rand.NewSource(mixSeed(seed, purpose)))
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+// 修改步骤的名称
+const (
+	stepFilter         = "filter" // tshark 过滤, 无法融合进流水线, 只能作为第一个步骤
+	stepPopTags        = "pop_tags"
+	stepDecap          = "decap"
+	stepP426           = "p426"
+	stepP624           = "p624"
+	stepShufflePacket  = "shuffle_packet"
+	stepShufflePayload = "shuffle_payload"
+	stepMutate         = "mutate"
+	stepAdjustTime     = "adjust_time"
+	stepPort           = "port"
+	stepIP             = "ip"
+	stepAnonymize      = "anonymize" // 即开启了 anonymize 的 ip 步骤
+	stepMac            = "mac"
+	stepResegment      = "resegment"
+	stepFragment       = "fragment"
+	stepImpair         = "impair"
+	stepMalform        = "malform"
+	stepEncap          = "encap"
+	stepPushTags       = "push_tags"
+	stepRetime         = "retime"
+)
+
+// defaultSteps 为不指定 steps 时的执行顺序, 只执行其中生效的步骤
+var defaultSteps = []string{stepPopTags, stepDecap, stepP426, stepP624, stepShufflePacket, stepShufflePayload, stepMutate,
+	stepAdjustTime, stepPort, stepIP, stepMac, stepResegment, stepFragment, stepImpair, stepMalform, stepEncap, stepPushTags, stepRetime}
+
+// stepsAllowedBefore / stepsAllowedAfter 限制某些步骤之前 / 之后只能出现的步骤:
+// pop_tags 之前的步骤看到的是带有标签的 packet; malform 损坏的首部无法被之后解析首部的步骤处理,
+// 之后增减 packet 也会使记录的 frame 序号错位; encap 和 push_tags 之后的步骤看到的是外层的首部
+var (
+	stepsAllowedBefore = map[string][]string{
+		stepPopTags: {stepFilter, stepPopTags, stepDecap},
+	}
+	stepsAllowedAfter = map[string][]string{
+		stepMalform:  {stepEncap, stepPushTags, stepRetime},
+		stepEncap:    {stepEncap, stepPushTags, stepRetime},
+		stepPushTags: {stepPushTags, stepRetime},
+	}
+)
+
+// modifierStepSpec 描述一个步骤可以使用的参数, enable 打开该步骤的开关 (可以为 nil), active 判断该步骤是否生效
+type modifierStepSpec struct {
+	params []string
+	enable func(m *Modifier)
+	active func(m *Modifier) bool
+}
+
+var modifierSteps = map[string]modifierStepSpec{
+	stepFilter: {
+		params: []string{"tshark_filter"},
+		active: func(m *Modifier) bool { return m.TsharkReadFilter != "" },
+	},
+	stepPopTags: {
+		params: []string{"pop_vlan", "pop_mpls"},
+		enable: func(m *Modifier) {
+			if !m.PopVlan && !m.PopMpls {
+				m.PopVlan, m.PopMpls = true, true
+			}
+		},
+		active: func(m *Modifier) bool { return m.PopVlan || m.PopMpls },
+	},
+	stepDecap: {
+		params: []string{"tunnel_port"},
+		enable: func(m *Modifier) { m.Decap = true },
+		active: func(m *Modifier) bool { return m.Decap },
+	},
+	stepP426: {
+		params: []string{"p426_prefix"},
+		enable: func(m *Modifier) { m.P426, m.P624 = true, false },
+		active: func(m *Modifier) bool { return m.P426 },
+	},
+	stepP624: {
+		params: []string{"p426_prefix", "p624_pool"},
+		enable: func(m *Modifier) { m.P426, m.P624 = false, true },
+		active: func(m *Modifier) bool { return m.P624 },
+	},
+	stepShufflePacket: {
+		params: []string{"shuffle_packet"},
+		enable: func(m *Modifier) {
+			if m.ShufflePacket == "" || m.ShufflePacket == "false" {
+				m.ShufflePacket = "true"
+			}
+		},
+		active: func(m *Modifier) bool { return m.shufflePacket },
+	},
+	stepShufflePayload: {
+		params: []string{"shuffle_payload"},
+		active: func(m *Modifier) bool { return m.ShufflePayload > 0 },
+	},
+	stepMutate: {
+		params: []string{"mutate", "mutate_keep", "mutate_rate", "mutate_dictionary"},
+		active: func(m *Modifier) bool { return m.Mutate != "" },
+	},
+	stepAdjustTime: {
+		params: []string{"time_offset"},
+		enable: func(m *Modifier) { m.AdjustTime = true },
+		active: func(m *Modifier) bool { return m.AdjustTime },
+	},
+	stepPort: {
+		params: []string{"port_map", "random_client_port"},
+		active: func(m *Modifier) bool { return len(m.portMap) > 0 || m.RandomClientPort },
+	},
+	stepIP: {
+		params: []string{"ip_map", "keep_ip", "anonymize", "anonymize_key", "c1", "c2", "c3", "c4", "s1", "s2", "s3", "s4",
+			"use_part_3", "use_part_4", "client6", "server6"},
+		active: func(m *Modifier) bool { return len(m.ipMap.rules) > 0 || m.Anonymize || !m.KeepIp },
+	},
+	stepAnonymize: {
+		params: []string{"ip_map", "anonymize_key"},
+		enable: func(m *Modifier) { m.Anonymize, m.KeepIp = true, false },
+		active: func(m *Modifier) bool { return m.Anonymize },
+	},
+	stepMac: {
+		params: []string{"mac_oui", "mac_pool"},
+		enable: func(m *Modifier) { m.RewriteMac = true },
+		active: func(m *Modifier) bool { return m.RewriteMac },
+	},
+	stepResegment: {
+		params: []string{"resegment", "resegment_overlap"},
+		active: func(m *Modifier) bool { return len(m.Resegment) > 0 },
+	},
+	stepFragment: {
+		params: []string{"fragment_mtu", "fragment_order"},
+		active: func(m *Modifier) bool { return m.FragmentMtu > 0 },
+	},
+	stepImpair: {
+		params: []string{"drop_rate", "duplicate_rate", "jitter", "reorder_rate", "reorder_distance", "reorder_scope"},
+		active: func(m *Modifier) bool {
+			return m.DropRate > 0 || m.DuplicateRate > 0 || m.Jitter > 0 || m.ReorderRate > 0
+		},
+	},
+	stepMalform: {
+		params: []string{"malform", "malform_rate"},
+		active: func(m *Modifier) bool { return len(m.malformKinds) > 0 },
+	},
+	stepEncap: {
+		params: []string{"tunnel", "tunnel_src", "tunnel_dst", "tunnel_key", "tunnel_port"},
+		active: func(m *Modifier) bool { return m.Tunnel != "" },
+	},
+	stepPushTags: {
+		params: []string{"push_vlan", "push_mpls"},
+		active: func(m *Modifier) bool { return len(m.PushVlan) > 0 || len(m.PushMpls) > 0 },
+	},
+	stepRetime: {
+		params: []string{"time_scale", "target_pps", "target_bps"},
+		active: func(m *Modifier) bool { return m.TimeScale > 0 || m.TargetPps > 0 || m.TargetBps > 0 },
+	},
+}
+
+// ModifierStep 是 steps 中的一个步骤, Name 为步骤名, 其余的键为该步骤的参数, 与 modifier 中同名的配置含义一致,
+// 未指定的参数使用 modifier 中的值, 比如 {name: fragment, fragment_mtu: 576}
+type ModifierStep struct {
+	Name   string                 `mapstructure:"name"`
+	Params map[string]interface{} `mapstructure:",remain"`
+
+	modifier *Modifier // 合并了参数并检查过的 modifier, 仅用于构建该步骤
+}
+
+func (s *ModifierStep) String() string {
+	return fmt.Sprintf("[Step %s]", s.Name)
+}
+
+// checkSteps 检查 steps 中的每个步骤, 并为其生成合并了参数的 modifier
+func (m *Modifier) checkSteps() error {
+	for i, step := range m.Steps {
+		if step == nil {
+			return errors.New(fmt.Sprintf("step at index %d is null", i))
+		}
+		spec, ok := modifierSteps[step.Name]
+		if !ok {
+			names := make([]string, 0, len(modifierSteps))
+			for name := range modifierSteps {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return errors.New(fmt.Sprintf("unknown step: %s, must be one of %s", step.Name, strings.Join(names, ", ")))
+		}
+		if step.Name == stepFilter && i != 0 {
+			return errors.New("filter step must be the first step")
+		}
+		for key := range step.Params {
+			if !contains(spec.params, key) {
+				return errors.New(fmt.Sprintf("unknown parameter %s for %s, available parameters are %s", key, step, strings.Join(spec.params, ", ")))
+			}
+		}
+
+		modifier := *m
+		modifier.Steps = nil
+		v := viper.New()
+		_ = v.MergeConfigMap(step.Params)
+		// 列表和 map 类型的参数整体替换 modifier 中的值
+		err := v.Unmarshal(&modifier, func(c *mapstructure.DecoderConfig) { c.ZeroFields = true })
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid parameters for %s: %s", step, err))
+		}
+		if spec.enable != nil {
+			spec.enable(&modifier)
+		}
+		if err := modifier.checkParams(); err != nil {
+			return errors.New(fmt.Sprintf("invalid parameters for %s: %s", step, err))
+		}
+		if !spec.active(&modifier) {
+			return errors.New(fmt.Sprintf("%s has no effect, please check its parameters", step))
+		}
+		step.modifier = &modifier
+	}
+
+	if err := m.checkStepOrder(); err != nil {
+		return err
+	}
+
+	// ip 步骤按照 steps 中是否有 p426 / p624 决定是否生成 IPv6 网段
+	for _, step := range m.Steps {
+		if step.Name == stepIP || step.Name == stepAnonymize {
+			step.modifier.P426 = m.hasStep(stepP426)
+			step.modifier.P624 = m.hasStep(stepP624)
+		}
+	}
+	return nil
+}
+
+// checkStepOrder 按照 stepsAllowedBefore / stepsAllowedAfter 检查步骤的顺序
+func (m *Modifier) checkStepOrder() error {
+	for i, step := range m.Steps {
+		if allowed, ok := stepsAllowedBefore[step.Name]; ok {
+			for _, before := range m.Steps[:i] {
+				if !contains(allowed, before.Name) {
+					return errors.New(fmt.Sprintf("%s must be placed after %s", before, step))
+				}
+			}
+		}
+		if allowed, ok := stepsAllowedAfter[step.Name]; ok {
+			for _, after := range m.Steps[i+1:] {
+				if !contains(allowed, after.Name) {
+					return errors.New(fmt.Sprintf("%s must be placed before %s", after, step))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Modifier) hasStep(name string) bool {
+	for _, step := range m.Steps {
+		if step.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// pipelineSteps 返回需要执行的步骤, 未指定 steps 时按照 defaultSteps 的顺序返回生效的步骤, 使用 modifier 本身的配置
+// 放大时总是需要 ip 步骤改写客户端地址, steps 中没有 ip / anonymize 步骤时在最后追加一个保留 IP 的 ip 步骤
+func (m *Modifier) pipelineSteps(amplify bool) []*ModifierStep {
+	if len(m.Steps) > 0 {
+		if amplify && !m.hasStep(stepIP) && !m.hasStep(stepAnonymize) {
+			steps := append([]*ModifierStep(nil), m.Steps...)
+			return append(steps, &ModifierStep{Name: stepIP, modifier: &Modifier{KeepIp: true}})
+		}
+		return m.Steps
+	}
+	var steps []*ModifierStep
+	for _, name := range defaultSteps {
+		if modifierSteps[name].active(m) || (name == stepIP && amplify) {
+			steps = append(steps, &ModifierStep{Name: name, modifier: m})
+		}
+	}
+	return steps
+}
+
+// keepIP 判断是否保留原始 IP, 指定 steps 时只要有一个 ip / anonymize 步骤改写 IP 即不保留
+func (m *Modifier) keepIP() bool {
+	if len(m.Steps) == 0 {
+		return m.KeepIp
+	}
+	for _, step := range m.Steps {
+		if (step.Name == stepIP || step.Name == stepAnonymize) && !step.modifier.KeepIp {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Modifier) adjustTime() bool {
+	if len(m.Steps) == 0 {
+		return m.AdjustTime
+	}
+	return m.hasStep(stepAdjustTime)
+}
+
+func (m *Modifier) tsharkFilter() string {
+	if len(m.Steps) == 0 {
+		return m.TsharkReadFilter
+	}
+	if m.Steps[0].Name == stepFilter {
+		return m.Steps[0].modifier.TsharkReadFilter
+	}
+	return ""
+}
+
+// retimeModifiers 按照执行的顺序返回 retime 步骤使用的配置
+func (m *Modifier) retimeModifiers() []*Modifier {
+	if len(m.Steps) == 0 {
+		if modifierSteps[stepRetime].active(m) {
+			return []*Modifier{m}
+		}
+		return nil
+	}
+	var modifiers []*Modifier
+	for _, step := range m.Steps {
+		if step.Name == stepRetime {
+			modifiers = append(modifiers, step.modifier)
+		}
+	}
+	return modifiers
+}
+
+func (m *Modifier) malform() bool {
+	if len(m.Steps) == 0 {
+		return len(m.malformKinds) > 0
+	}
+	return m.hasStep(stepMalform)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// VLAN ID 和 MPLS label 的取值范围, 0 表示按流随机生成
+const (
+	vlanIdMax    = 4094    // 4095 保留
+	mplsLabelMin = 16      // 0 - 15 为保留 label
+	mplsLabelMax = 1048575 // 20 位
+)
+
+func checkVlanIds(ids []int) error {
+	for _, id := range ids {
+		if id < 0 || id > vlanIdMax {
+			return errors.New(fmt.Sprintf("invalid vlan id: %d, must be in [1, %d] or 0 for random", id, vlanIdMax))
+		}
+	}
+	return nil
+}
+
+func checkMplsLabels(labels []int) error {
+	for _, label := range labels {
+		if label != 0 && (label < mplsLabelMin || label > mplsLabelMax) {
+			return errors.New(fmt.Sprintf("invalid mpls label: %d, must be in [%d, %d] or 0 for random", label, mplsLabelMin, mplsLabelMax))
+		}
+	}
+	return nil
+}
+
+// vlanTag 记录标签本身和标识它的 TPID (802.1Q 为 0x8100, QinQ 外层为 0x88a8)
+type vlanTag struct {
+	tpid layers.EthernetType
+	tag  layers.Dot1Q
+}
+
+// tagRewriter 弹出和压入以太网帧中的 VLAN 标签 (802.1Q / QinQ) 和 MPLS label, 先弹出再压入, 三层及以上的数据保持不变
+// 压入的 ID 为 0 时按流随机生成, 同一个流的两个方向总是使用同样的 ID
+type tagRewriter struct {
+	popVlan  bool
+	popMpls  bool
+	pushVlan []int // 外层在前
+	pushMpls []int // 外层在前
+	seed     int64
+}
+
+// rewrite 返回修改后的数据, 没有需要弹出或压入的标签时直接返回原数据
+func (t *tagRewriter) rewrite(packet gopacket.Packet) ([]byte, error) {
+	data := packet.Data()
+
+	var eth *layers.Ethernet
+	var vlans []vlanTag
+	var labels []layers.MPLS
+	offset := 0
+	nextType := layers.EthernetType(0) // 下一层的 ether type
+LAYERS:
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.Ethernet:
+			if l.Length != 0 {
+				return nil, fmt.Errorf("802.3 frame is not supported")
+			}
+			eth = l
+			nextType = l.EthernetType
+		case *layers.Dot1Q:
+			if len(labels) > 0 {
+				break LAYERS
+			}
+			vlans = append(vlans, vlanTag{tpid: nextType, tag: *l})
+			nextType = l.Type
+		case *layers.MPLS:
+			labels = append(labels, *l)
+		default:
+			break LAYERS
+		}
+		offset += len(layer.LayerContents())
+	}
+	if eth == nil {
+		return nil, fmt.Errorf("not an ethernet frame")
+	}
+	rest := data[offset:]
+
+	// 标签之后的三层类型, MPLS 中没有类型字段, 根据版本号猜测
+	mplsType, inner := layers.EthernetType(0), nextType
+	if len(labels) > 0 {
+		mplsType, inner = nextType, 0
+		if len(rest) > 0 {
+			switch rest[0] >> 4 {
+			case 4:
+				inner = layers.EthernetTypeIPv4
+			case 6:
+				inner = layers.EthernetTypeIPv6
+			}
+		}
+	}
+
+	if (!t.popVlan || len(vlans) == 0) && (!t.popMpls || len(labels) == 0) && len(t.pushVlan) == 0 && len(t.pushMpls) == 0 {
+		return data, nil
+	}
+
+	if t.popVlan {
+		vlans = nil
+	}
+	if t.popMpls && len(labels) > 0 {
+		if inner == 0 {
+			return nil, fmt.Errorf("cannot pop mpls labels, payload is neither IPv4 nor IPv6")
+		}
+		labels = nil
+	}
+
+	if len(t.pushMpls) > 0 {
+		if len(labels) == 0 {
+			if inner != layers.EthernetTypeIPv4 && inner != layers.EthernetTypeIPv6 {
+				return nil, fmt.Errorf("cannot push mpls labels on %s", inner)
+			}
+			mplsType = layers.EthernetTypeMPLSUnicast
+		}
+		pushed := make([]layers.MPLS, len(t.pushMpls))
+		for i, label := range t.pushMpls {
+			if label == 0 {
+				label = mplsLabelMin + t.random(rest, inner, "mpls", i)%(mplsLabelMax-mplsLabelMin+1)
+			}
+			pushed[i] = layers.MPLS{Label: uint32(label), TTL: 64}
+		}
+		labels = append(pushed, labels...)
+		labels[len(labels)-1].StackBottom = true
+	}
+
+	if len(t.pushVlan) > 0 {
+		pushed := make([]vlanTag, len(t.pushVlan))
+		for i, id := range t.pushVlan {
+			if id == 0 {
+				id = 1 + t.random(rest, inner, "vlan", i)%vlanIdMax
+			}
+			pushed[i] = vlanTag{tag: layers.Dot1Q{VLANIdentifier: uint16(id)}}
+		}
+		vlans = append(pushed, vlans...)
+		// 多层标签时外层使用 QinQ 的 TPID
+		for i := range vlans {
+			vlans[i].tpid = layers.EthernetTypeDot1Q
+		}
+		if len(vlans) > 1 {
+			vlans[0].tpid = layers.EthernetTypeQinQ
+		}
+	}
+
+	// 从内向外确定每一层的 ether type
+	nextType = inner
+	if len(labels) > 0 {
+		nextType = mplsType
+	}
+	serializableLayers := make([]gopacket.SerializableLayer, 0, 2+len(vlans)+len(labels))
+	newEth := *eth
+	serializableLayers = append(serializableLayers, &newEth)
+	for i := range vlans {
+		serializableLayers = append(serializableLayers, &vlans[i].tag)
+	}
+	for i := range labels {
+		serializableLayers = append(serializableLayers, &labels[i])
+	}
+	serializableLayers = append(serializableLayers, gopacket.Payload(rest))
+
+	for i := len(vlans) - 1; i >= 0; i-- {
+		vlans[i].tag.Type = nextType
+		nextType = vlans[i].tpid
+	}
+	newEth.EthernetType = nextType
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, serializableLayers...); err != nil {
+		return nil, fmt.Errorf("cannot serialize packet: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// random 为流生成第 i 个随机 ID, 与方向无关, 非 IP 的 packet 共用同一个 ID
+func (t *tagRewriter) random(l3 []byte, etherType layers.EthernetType, purpose string, i int) int {
+	return int(uint64(mixSeed(t.seed, purpose, strconv.Itoa(i), undirectedFlowKey(l3, etherType))) >> 1)
+}
+
+// undirectedFlowKey 返回与方向无关的流标识, 由协议和排序后的两端地址及端口组成, 非 IP 的 packet 返回空字符串
+func undirectedFlowKey(l3 []byte, etherType layers.EthernetType) string {
+	if etherType != layers.EthernetTypeIPv4 && etherType != layers.EthernetTypeIPv6 {
+		return ""
+	}
+	view, ok := parseIPHeaderView(l3, 0)
+	if !ok {
+		return ""
+	}
+
+	a, b := string(view.src), string(view.dst)
+	var aPort, bPort uint16
+	if (view.protocol == layers.IPProtocolTCP || view.protocol == layers.IPProtocolUDP) && view.l4Offset >= 0 && view.l4Offset+4 <= len(l3) {
+		aPort = binary.BigEndian.Uint16(l3[view.l4Offset:])
+		bPort = binary.BigEndian.Uint16(l3[view.l4Offset+2:])
+	}
+	if a > b || (a == b && aPort > bPort) {
+		a, b, aPort, bPort = b, a, bPort, aPort
+	}
+	return fmt.Sprintf("%d|%x|%d|%x|%d", view.protocol, a, aPort, b, bPort)
+}
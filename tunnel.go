@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// 隧道类型
+const (
+	tunnelGRE    = "gre"
+	tunnelVXLAN  = "vxlan"
+	tunnelGENEVE = "geneve"
+	tunnelIPIP   = "ipip"
+
+	vxlanPort  = 4789
+	genevePort = 6081
+
+	// 默认使用 RFC 5737 的文档地址
+	defaultTunnelSrc = "192.0.2.1"
+	defaultTunnelDst = "192.0.2.2"
+)
+
+// parseTunnelEndpoints 解析隧道外层的 IP, 两端必须同为 IPv4 或 IPv6
+func parseTunnelEndpoints(src, dst string) (net.IP, net.IP, error) {
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	if srcIP == nil {
+		return nil, nil, errors.New(fmt.Sprintf("invalid tunnel src: %s", src))
+	}
+	if dstIP == nil {
+		return nil, nil, errors.New(fmt.Sprintf("invalid tunnel dst: %s", dst))
+	}
+	if (srcIP.To4() == nil) != (dstIP.To4() == nil) {
+		return nil, nil, errors.New(fmt.Sprintf("tunnel src %s and dst %s must be the same ip version", src, dst))
+	}
+	if srcIP.To4() != nil {
+		return srcIP.To4(), dstIP.To4(), nil
+	}
+	return srcIP, dstIP, nil
+}
+
+// ipDatagram 去掉以太网帧末尾的填充, 数据被截断时返回已有的部分
+func ipDatagram(ip []byte) []byte {
+	length := len(ip)
+	switch {
+	case len(ip) >= 20 && ip[0]>>4 == 4:
+		length = int(binary.BigEndian.Uint16(ip[2:4]))
+	case len(ip) >= 40 && ip[0]>>4 == 6:
+		length = 40 + int(binary.BigEndian.Uint16(ip[4:6]))
+	}
+	if length > 0 && length < len(ip) {
+		return ip[:length]
+	}
+	return ip
+}
+
+// tunnelEncapsulator 将以太网帧封装到隧道中, 外层的 MAC 地址沿用原始帧
+// VXLAN / GENEVE 封装整个以太网帧; GRE 封装 IP datagram, 非 IP 的帧使用 transparent ethernet bridging 封装整个帧;
+// IP-in-IP 只能封装 IP datagram
+type tunnelEncapsulator struct {
+	kind     string
+	src, dst net.IP // 客户端发出的 packet 从 src 发往 dst, 服务端发出的相反
+	key      uint32 // VXLAN / GENEVE 的 VNI, GRE 的 key
+	port     uint16 // VXLAN / GENEVE 的 UDP 目的端口
+	seed     int64
+}
+
+func (t *tunnelEncapsulator) encapsulate(data []byte, fromClient bool) ([]byte, error) {
+	offset, etherType, err := ethernetTypeOffset(data)
+	if err != nil {
+		return nil, err
+	}
+	isIP := etherType == layers.EthernetTypeIPv4 || etherType == layers.EthernetTypeIPv6
+	var inner []byte
+	if isIP {
+		inner = ipDatagram(data[offset+2:])
+	}
+
+	src, dst := t.src, t.dst
+	if !fromClient {
+		src, dst = dst, src
+	}
+
+	var tunnelLayers []gopacket.SerializableLayer
+	var protocol layers.IPProtocol
+	var udp *layers.UDP
+	switch t.kind {
+	case tunnelVXLAN, tunnelGENEVE:
+		// 源端口由内层的流决定, 与方向无关, 使得同一个流的 packet 总是经过同一条路径
+		srcPort := ephemeralPortMin + uint64(mixSeed(t.seed, undirectedFlowKey(inner, etherType)))%(ephemeralPortMax-ephemeralPortMin+1)
+		protocol = layers.IPProtocolUDP
+		udp = &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(t.port)}
+		tunnelLayers = append(tunnelLayers, udp)
+		if t.kind == tunnelVXLAN {
+			tunnelLayers = append(tunnelLayers, &layers.VXLAN{ValidIDFlag: true, VNI: t.key}, gopacket.Payload(data))
+		} else {
+			// gopacket 不支持序列化 GENEVE, 直接构造不带选项的首部
+			header := make([]byte, 8)
+			binary.BigEndian.PutUint16(header[2:4], uint16(layers.EthernetTypeTransparentEthernetBridging))
+			binary.BigEndian.PutUint32(header[4:8], t.key<<8)
+			tunnelLayers = append(tunnelLayers, gopacket.Payload(append(header, data...)))
+		}
+	case tunnelGRE:
+		protocol = layers.IPProtocolGRE
+		gre := &layers.GRE{KeyPresent: t.key != 0, Key: t.key, Protocol: layers.EthernetTypeTransparentEthernetBridging}
+		payload := data
+		if isIP {
+			gre.Protocol = etherType
+			payload = inner
+		}
+		tunnelLayers = append(tunnelLayers, gre, gopacket.Payload(payload))
+	case tunnelIPIP:
+		if !isIP {
+			return nil, fmt.Errorf("cannot encapsulate %s in ip-in-ip", etherType)
+		}
+		protocol = layers.IPProtocolIPv4
+		if etherType == layers.EthernetTypeIPv6 {
+			protocol = layers.IPProtocolIPv6
+		}
+		tunnelLayers = append(tunnelLayers, gopacket.Payload(inner))
+	default:
+		return nil, fmt.Errorf("unknown tunnel type %s", t.kind)
+	}
+
+	eth := &layers.Ethernet{DstMAC: data[0:6], SrcMAC: data[6:12]}
+	var network gopacket.NetworkLayer
+	if src.To4() != nil {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		network = &layers.IPv4{Version: 4, TTL: 64, Flags: layers.IPv4DontFragment, Protocol: protocol, SrcIP: src, DstIP: dst}
+	} else {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		network = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: protocol, SrcIP: src, DstIP: dst}
+	}
+	if udp != nil {
+		_ = udp.SetNetworkLayerForChecksum(network)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	allLayers := append([]gopacket.SerializableLayer{eth, network.(gopacket.SerializableLayer)}, tunnelLayers...)
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, allLayers...); err != nil {
+		return nil, fmt.Errorf("cannot serialize packet: %w", err)
+	}
+
+	// 按照 RFC 7348 的建议, IPv4 外层的 UDP 不计算校验和
+	b := buf.Bytes()
+	if udp != nil && src.To4() != nil {
+		binary.BigEndian.PutUint16(b[14+20+6:], 0)
+	}
+	return b, nil
+}
+
+// tunnelDecapsulator 还原隧道中的内层数据, 内层为 IP datagram 时沿用外层的二层首部
+// 支持 GRE, 标准端口 (或指定端口) 上的 VXLAN / GENEVE, 以及 IP-in-IP, 其余 packet 原样返回
+type tunnelDecapsulator struct {
+	vxlanPort  uint16
+	genevePort uint16
+}
+
+// decapsulate 返回内层数据, 不是隧道 packet 时返回 nil
+func (t *tunnelDecapsulator) decapsulate(data []byte) ([]byte, error) {
+	view, ok := parseIPPacketView(data)
+	if !ok || view.l4Offset < 0 {
+		return nil, nil
+	}
+	if view.version == 4 && data[view.ipOffset+6]&0x20 != 0 {
+		return nil, fmt.Errorf("cannot decapsulate fragmented packet")
+	}
+	end := view.ipOffset + len(ipDatagram(data[view.ipOffset:]))
+	if view.l4Offset > end {
+		return nil, nil
+	}
+	l4 := data[view.l4Offset:end]
+	etherTypeOffset := view.ipOffset - 2
+
+	switch view.protocol {
+	case layers.IPProtocolIPv4:
+		return replaceEthernetPayload(data, etherTypeOffset, layers.EthernetTypeIPv4, l4), nil
+	case layers.IPProtocolIPv6:
+		return replaceEthernetPayload(data, etherTypeOffset, layers.EthernetTypeIPv6, l4), nil
+	case layers.IPProtocolGRE:
+		if len(l4) < 4 {
+			return nil, fmt.Errorf("truncated gre header")
+		}
+		flags := binary.BigEndian.Uint16(l4[0:2])
+		if flags&0x4007 != 0 {
+			return nil, fmt.Errorf("gre routing or version %d is not supported", flags&0x7)
+		}
+		length := 4
+		for _, bit := range []uint16{0x8000, 0x2000, 0x1000} { // checksum, key, sequence
+			if flags&bit != 0 {
+				length += 4
+			}
+		}
+		if len(l4) < length {
+			return nil, fmt.Errorf("truncated gre header")
+		}
+		return decapsulatePayload(data, etherTypeOffset, layers.EthernetType(binary.BigEndian.Uint16(l4[2:4])), l4[length:])
+	case layers.IPProtocolUDP:
+		if len(l4) < 8 {
+			return nil, nil
+		}
+		switch binary.BigEndian.Uint16(l4[2:4]) {
+		case t.vxlanPort:
+			if len(l4) < 16 {
+				return nil, fmt.Errorf("truncated vxlan header")
+			}
+			return l4[16:], nil
+		case t.genevePort:
+			if len(l4) < 16 {
+				return nil, fmt.Errorf("truncated geneve header")
+			}
+			length := 8 + 8 + int(l4[8]&0x3f)*4
+			if len(l4) < length {
+				return nil, fmt.Errorf("truncated geneve header")
+			}
+			return decapsulatePayload(data, etherTypeOffset, layers.EthernetType(binary.BigEndian.Uint16(l4[10:12])), l4[length:])
+		}
+	}
+	return nil, nil
+}
+
+// decapsulatePayload 根据内层协议还原以太网帧
+func decapsulatePayload(data []byte, etherTypeOffset int, protocol layers.EthernetType, payload []byte) ([]byte, error) {
+	switch protocol {
+	case layers.EthernetTypeTransparentEthernetBridging:
+		if len(payload) < 14 {
+			return nil, fmt.Errorf("truncated inner ethernet frame")
+		}
+		return payload, nil
+	case layers.EthernetTypeIPv4, layers.EthernetTypeIPv6:
+		return replaceEthernetPayload(data, etherTypeOffset, protocol, payload), nil
+	}
+	return nil, fmt.Errorf("inner protocol %s is not supported", protocol)
+}